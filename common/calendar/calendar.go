@@ -0,0 +1,171 @@
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+	"github.com/golazycat/lazycron/common/schedule"
+)
+
+const (
+	dateFormat     = "2006-01-02"
+	dateTimeFormat = "2006-01-02 15:04:05"
+)
+
+// 解析后的日历，用于判断某个时间是否在日历中
+// worker调度前和master校验日历时都通过这个结构解析日历
+type Calendar struct {
+	name     string
+	location *time.Location
+	dates    map[string]bool
+	windows  []window
+}
+
+// 解析后的时间窗口，schedule不为nil时为周期窗口
+type window struct {
+	start    time.Time
+	end      time.Time
+	schedule *schedule.Schedule
+	duration time.Duration
+}
+
+// 解析日历，日期、窗口或者时区不合法时返回错误
+func Compile(calendar *protocol.Calendar) (*Calendar, error) {
+
+	location, err := schedule.LoadLocation(calendar.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone '%s'", calendar.Timezone)
+	}
+
+	compiled := &Calendar{
+		name:     calendar.Name,
+		location: location,
+		dates:    make(map[string]bool, len(calendar.Dates)),
+		windows:  make([]window, 0, len(calendar.Windows)),
+	}
+
+	for _, date := range calendar.Dates {
+		if err := CheckDate(date, location); err != nil {
+			return nil, err
+		}
+		compiled.dates[date] = true
+	}
+
+	for i, w := range calendar.Windows {
+		compiledWindow, err := compileWindow(w, location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %d: %s", i, err)
+		}
+		compiled.windows = append(compiled.windows, compiledWindow)
+	}
+
+	return compiled, nil
+}
+
+// 检查日期的格式是否正确
+func CheckDate(date string, location *time.Location) error {
+	if _, err := time.ParseInLocation(dateFormat, date, location); err != nil {
+		return fmt.Errorf("invalid date '%s'", date)
+	}
+	return nil
+}
+
+// 检查时间窗口是否正确
+func CheckWindow(w *protocol.CalendarWindow, location *time.Location) error {
+	_, err := compileWindow(w, location)
+	return err
+}
+
+// 解析一个时间窗口
+func compileWindow(w *protocol.CalendarWindow, location *time.Location) (window, error) {
+
+	if w == nil {
+		return window{}, fmt.Errorf("window is required")
+	}
+
+	if w.CronExpr != "" {
+		if w.Duration <= 0 {
+			return window{}, fmt.Errorf("duration must be positive")
+		}
+		windowSchedule, err := schedule.Parse(&protocol.Job{
+			CronExpr: w.CronExpr,
+			Timezone: location.String(),
+		})
+		if err != nil {
+			return window{}, err
+		}
+		return window{
+			schedule: windowSchedule,
+			duration: time.Duration(w.Duration) * time.Second,
+		}, nil
+	}
+
+	start, err := time.ParseInLocation(dateTimeFormat, w.Start, location)
+	if err != nil {
+		return window{}, fmt.Errorf("invalid start '%s'", w.Start)
+	}
+	end, err := time.ParseInLocation(dateTimeFormat, w.End, location)
+	if err != nil {
+		return window{}, fmt.Errorf("invalid end '%s'", w.End)
+	}
+	if !end.After(start) {
+		return window{}, fmt.Errorf("end must be after start")
+	}
+	return window{start: start, end: end}, nil
+}
+
+// 日历名称
+func (calendar *Calendar) Name() string {
+	return calendar.name
+}
+
+// 判断时间t是否在日历中，即t所在的日期在日历的日期中，或者t在日历的某个时间窗口中
+func (calendar *Calendar) Contains(t time.Time) bool {
+
+	if calendar.dates[t.In(calendar.location).Format(dateFormat)] {
+		return true
+	}
+
+	for _, w := range calendar.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断时间t是否在窗口中
+// 周期窗口在(t-duration, t]之间有开始时间时，t就在这个窗口中
+func (w window) contains(t time.Time) bool {
+
+	if w.schedule == nil {
+		return !t.Before(w.start) && t.Before(w.end)
+	}
+
+	start := w.schedule.Next(t.Add(-w.duration))
+	return !start.IsZero() && !start.After(t)
+}
+
+// 依据job引用的日历判断计划时间t是否应该跳过，不需要跳过时返回""，否则返回跳过的原因
+// t在任意一个排除日历中时跳过；job设置了包含日历时，t不在任何一个包含日历中也跳过
+// calendars为所有日历，key为日历名称，job引用了不存在的日历时，视为这个日历不包含任何时间
+func SkipReason(job *protocol.Job, calendars map[string]*Calendar, t time.Time) string {
+
+	for _, name := range job.ExcludeCalendars {
+		if calendar, exists := calendars[name]; exists && calendar.Contains(t) {
+			return fmt.Sprintf("excluded by calendar %s", name)
+		}
+	}
+
+	if len(job.IncludeCalendars) == 0 {
+		return ""
+	}
+	for _, name := range job.IncludeCalendars {
+		if calendar, exists := calendars[name]; exists && calendar.Contains(t) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("not included in calendars %s", strings.Join(job.IncludeCalendars, ", "))
+}
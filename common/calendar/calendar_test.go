@@ -0,0 +1,67 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestCalendar(t *testing.T) {
+
+	holidays, err := Compile(&protocol.Calendar{
+		Name:     "holidays",
+		Timezone: "Asia/Shanghai",
+		Dates:    []string{"2020-10-01"},
+		Windows: []*protocol.CalendarWindow{
+			{Start: "2020-12-23 18:00:00", End: "2020-12-24 00:00:00"},
+			// 每周五18点开始的周末
+			{CronExpr: "0 18 * * FRI", Duration: 54 * 3600},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error Compile: %v", err)
+	}
+
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	cases := []struct {
+		t        time.Time
+		contains bool
+	}{
+		{time.Date(2020, 10, 1, 23, 59, 0, 0, shanghai), true},
+		// 上海的10月1日0点是UTC的9月30日16点
+		{time.Date(2020, 9, 30, 16, 0, 0, 0, time.UTC), true},
+		{time.Date(2020, 10, 2, 0, 0, 0, 0, shanghai), false},
+		{time.Date(2020, 12, 23, 18, 0, 0, 0, shanghai), true},
+		{time.Date(2020, 12, 24, 0, 0, 0, 0, shanghai), false},
+		{time.Date(2020, 11, 6, 17, 59, 0, 0, shanghai), false},
+		{time.Date(2020, 11, 6, 18, 0, 0, 0, shanghai), true},
+		{time.Date(2020, 11, 8, 23, 59, 0, 0, shanghai), true},
+		{time.Date(2020, 11, 9, 0, 0, 0, 0, shanghai), false},
+	}
+	for _, c := range cases {
+		if holidays.Contains(c.t) != c.contains {
+			t.Errorf("Error Contains(%s): expect %v", c.t, c.contains)
+		}
+	}
+
+	calendars := map[string]*Calendar{"holidays": holidays}
+	job := &protocol.Job{Name: "report", ExcludeCalendars: []string{"holidays"}}
+	if SkipReason(job, calendars, time.Date(2020, 10, 1, 9, 0, 0, 0, shanghai)) == "" {
+		t.Errorf("Error SkipReason: expect excluded")
+	}
+	job = &protocol.Job{Name: "report", IncludeCalendars: []string{"holidays", "missing"}}
+	if SkipReason(job, calendars, time.Date(2020, 10, 2, 9, 0, 0, 0, shanghai)) == "" {
+		t.Errorf("Error SkipReason: expect not included")
+	}
+
+	for _, bad := range []*protocol.Calendar{
+		{Name: "bad", Dates: []string{"2020-13-01"}},
+		{Name: "bad", Windows: []*protocol.CalendarWindow{{CronExpr: "0 18 * * FRI"}}},
+		{Name: "bad", Windows: []*protocol.CalendarWindow{{Start: "2020-12-26 00:00:00", End: "2020-12-24 00:00:00"}}},
+	} {
+		if _, err := Compile(bad); err == nil {
+			t.Errorf("Error Compile: expect error for %+v", bad)
+		}
+	}
+}
@@ -7,6 +7,25 @@ const (
 	JobKillPrefix   = "/lazycron/kill/"
 	JobLockPrefix   = "/lazycron/lock/"
 	JobWorkerPrefix = "/lazycron/worker/"
+	JobOutputPrefix = "/lazycron/output/"
+	JobRunPrefix    = "/lazycron/run/"
+	JobFiredPrefix  = "/lazycron/fired/"
+	JobClaimPrefix  = "/lazycron/claim/"
+	JobFinishPrefix = "/lazycron/finish/"
+	CalendarPrefix  = "/lazycron/calendars/"
+
+	// 记录job调度执行的次数，执行次数为key的Version，即key被写入的次数
+	JobRunCountPrefix = "/lazycron/runcount/"
+	// worker上报的kill结果，key为JobKillReportPrefix/jobName/runId
+	JobKillReportPrefix = "/lazycron/killreport/"
+	// 正在执行的实例，key为JobRunningPrefix/jobName/runId，使用执行的锁租约，执行结束后被删除
+	JobRunningPrefix = "/lazycron/running/"
+
+	WorkflowPrefix       = "/lazycron/workflows/"
+	WorkflowRunPrefix    = "/lazycron/wfrun/"
+	WorkflowResultPrefix = "/lazycron/wfresult/"
+	// 认领工作流的计划时间，key为WorkflowFiredPrefix/workflowName/planTime
+	WorkflowFiredPrefix = "/lazycron/wffired/"
 
 	// mongodb中用到的常量
 	MongodbDatabase   = "lazycron"
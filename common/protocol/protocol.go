@@ -10,6 +10,103 @@ const (
 	JobEventDelete = iota
 	JobEventUpdate
 	JobEventKill
+	JobEventRun
+	JobEventCalendarUpdate
+	JobEventCalendarDelete
+)
+
+// Job执行状态枚举，记录在JobLog中
+const (
+	// 执行成功
+	JobStatusSuccess = "success"
+	// 执行失败，命令返回了非0的退出码或者无法启动
+	JobStatusFailed = "failed"
+	// 执行中被kill
+	JobStatusKilled = "killed"
+	// 执行超时
+	JobStatusTimeout = "timeout"
+	// 其它worker正在执行，抢锁失败而跳过
+	JobStatusLockSkipped = "lock_skipped"
+	// 因为日历的限制而跳过，跳过的原因记录在SkipReason中
+	JobStatusSkipped = "skipped"
+	// 超过cgroup的内存限制，被内核OOM killer杀死
+	JobStatusOomKilled = "oom_killed"
+)
+
+// Job类型枚举，决定job如何执行
+const (
+	// 通过shell执行Command
+	JobTypeShell = "shell"
+	// 不经过shell，直接执行Args，Args[0]为可执行文件
+	JobTypeExec = "exec"
+	// 发送Http请求
+	JobTypeHttp = "http"
+)
+
+// Job调度方式枚举
+const (
+	// 依据cron表达式周期执行
+	ScheduleCron = "cron"
+	// 在RunAt指定的时间只执行一次
+	ScheduleOnce = "once"
+	// 固定频率，每隔Interval秒执行一次，执行时间对齐到Interval的整数倍
+	ScheduleEvery = "every"
+	// 固定延迟，上一次执行结束Interval秒之后再执行
+	ScheduleDelayAfterFinish = "delay_after_finish"
+)
+
+// 错过执行的处理策略枚举
+const (
+	// 跳过所有错过的执行
+	MisfireSkip = "skip"
+	// 立即补执行一次
+	MisfireRunOnce = "run_once"
+	// 依次补执行所有错过的执行，最多补执行Limit次
+	MisfireRunAll = "run_all"
+)
+
+// 并发执行策略枚举，决定job的上一次执行还没有结束时，新的执行如何处理
+const (
+	// 禁止并发，上一次执行没有结束时跳过新的执行
+	ConcurrencyForbid = "forbid"
+	// 允许并发，最多同时执行MaxConcurrent个实例
+	ConcurrencyAllow = "allow"
+	// 中断正在执行的实例，执行新的实例
+	ConcurrencyReplace = "replace"
+	// 排队等待，正在执行的实例达到MaxConcurrent个时，新的执行等待前面的执行结束
+	ConcurrencyQueue = "queue"
+)
+
+// 工作流中边的触发条件枚举
+const (
+	// 上游执行成功时触发
+	WorkflowOnSuccess = "success"
+	// 上游执行失败时触发
+	WorkflowOnFailure = "failure"
+	// 上游执行结束时总是触发
+	WorkflowOnAlways = "always"
+)
+
+// 工作流运行和节点的状态枚举
+const (
+	// 节点等待上游执行结束
+	WorkflowStatusPending = "pending"
+	// 工作流或节点正在运行
+	WorkflowStatusRunning = "running"
+	// 工作流的所有节点执行结束且没有失败的节点，或者节点执行成功
+	WorkflowStatusSuccess = "success"
+	// 工作流有失败的节点，或者节点执行失败
+	WorkflowStatusFailed = "failed"
+	// 节点因为上游的结果不满足边的条件而跳过
+	WorkflowStatusSkipped = "skipped"
+)
+
+// 重试退避方式枚举
+const (
+	// 固定间隔重试
+	RetryBackoffFixed = "fixed"
+	// 指数退避重试，每次重试的间隔翻倍
+	RetryBackoffExponential = "exponential"
 )
 
 // 定时任务结构
@@ -17,27 +114,340 @@ const (
 type Job struct {
 	// 任务名称
 	Name string `json:"name"`
-	// 任务命令
+	// 任务类型，见JobTypeXxx枚举，默认为shell
+	Type string `json:"type"`
+	// 任务命令，shell类型的任务使用
 	Command string `json:"command"`
+	// 命令的参数列表，第一个参数为可执行文件，exec类型的任务使用
+	Args []string `json:"args"`
+	// Http请求，http类型的任务使用
+	Http *HttpRequest `json:"http"`
+	// 执行shell类型任务使用的shell，为空时使用/bin/bash
+	Shell string `json:"shell"`
+	// 任务的环境变量，会覆盖worker进程中同名的环境变量
+	Env map[string]string `json:"env"`
+	// 任务执行的工作目录，为空时使用worker进程的工作目录
+	Workdir string `json:"workdir"`
+	// 以指定的用户和用户组执行任务，用户必须在worker的allowed_users配置中
+	RunAs *RunAs `json:"run_as"`
+	// 任务进程的资源限制
+	Rlimits *Rlimits `json:"rlimits"`
+	// 任务进程所在cgroup的资源限制，需要worker开启cgroup
+	Cgroup *CgroupLimits `json:"cgroup"`
 	// Cron 表达式
+	// cron表达式中可以使用H，H会依据任务名称展开为固定的值，使相同表达式的任务分散执行
 	CronExpr string `json:"cron_expr"`
+	// 计算cron表达式使用的IANA时区，例如"Asia/Shanghai"，为空时使用worker的本机时区
+	Timezone string `json:"timezone"`
+	// 调度方式，见ScheduleXxx枚举，默认为cron；其它调度方式不需要cron表达式
+	ScheduleType string `json:"schedule_type"`
+	// 一次性job的执行时间，毫秒时间戳
+	RunAt int64 `json:"run_at"`
+	// 一次性job在保存之后延迟多少秒执行，master保存job时会把它转换为RunAt
+	Delay int `json:"delay"`
+	// every和delay_after_finish调度方式的间隔，单位为秒
+	Interval int `json:"interval"`
+	// job开始调度的毫秒时间戳，为0表示不限制；这个时间之前的计划时间不会执行
+	StartAt int64 `json:"start_at"`
+	// job结束调度的毫秒时间戳，为0表示不限制；这个时间之后的计划时间不会执行
+	EndAt int64 `json:"end_at"`
+	// job最多调度执行的次数，为0表示不限制；手动执行、重试和跳过的执行不计入次数
+	MaxRuns int `json:"max_runs"`
+	// 调度执行前的随机延迟窗口，单位为秒，为0表示不延迟
+	// 延迟由任务名称和计划时间决定，同一次执行在所有worker上的延迟相同
+	Jitter int `json:"jitter"`
+	// 任务执行超时时间，单位为秒，为0表示不限制
+	Timeout int `json:"timeout"`
+	// 分布式锁租约的TTL，单位为秒，为0时使用默认值
+	// worker和etcd断开超过这个时间后锁会丢失，正在执行的任务会被中断
+	LockTTL int `json:"lock_ttl"`
+	// 任务超时后，从发送SIGTERM到发送SIGKILL的宽限时间，单位为秒
+	// 为0时使用worker的默认宽限时间
+	KillGrace int `json:"kill_grace"`
+	// stdout和stderr各自保存的最大字节数，超过时只保留开头和结尾的输出
+	// 为0时使用worker的默认配置
+	OutputLimit int `json:"output_limit"`
+	// 失败重试策略，为null表示失败后不重试
+	Retry *RetryPolicy `json:"retry"`
+	// 错过执行的处理策略，为null表示保持默认行为：只执行一次最早错过的执行
+	Misfire *MisfirePolicy `json:"misfire"`
+	// 并发执行策略，见ConcurrencyXxx枚举，默认为禁止并发
+	ConcurrencyPolicy string `json:"concurrency_policy"`
+	// allow和queue策略下，整个集群最多同时执行的实例数
+	// allow策略为0表示不限制，queue策略为0时为1
+	MaxConcurrent int `json:"max_concurrent"`
+	// 任务只在这些日历包含的时间执行，为空表示不限制
+	IncludeCalendars []string `json:"include_calendars"`
+	// 任务不在这些日历包含的时间执行，例如节假日、变更冻结期
+	ExcludeCalendars []string `json:"exclude_calendars"`
+	// 任务是否被暂停，暂停的任务不会被调度执行，但是仍然可以手动执行
+	Paused bool `json:"paused"`
+	// 任务被暂停的毫秒时间戳
+	PausedAt int64 `json:"paused_at"`
+	// 任务被暂停的原因
+	PauseReason string `json:"pause_reason"`
+	// 一次性job执行成功后是否直接删除，为false时标记为已完成
+	AutoDelete bool `json:"auto_delete"`
+	// 一次性job标记为已完成后保留的秒数，过期后被etcd自动删除，为0时使用默认值
+	CompletedTTL int `json:"completed_ttl"`
+	// 一次性job是否已经执行成功，已完成的job不会再被调度执行
+	Completed bool `json:"completed"`
+	// 一次性job执行成功的毫秒时间戳
+	CompletedAt int64 `json:"completed_at"`
+	// 以下字段由master在查询job时计算，保存job时会被忽略
+	// job已经调度执行的次数
+	Runs int64 `json:"runs"`
+	// job是否已经过期：超过了结束调度的时间，或者执行次数达到了MaxRuns
+	Expired bool `json:"expired"`
+}
+
+// 执行任务进程的用户，Group为空时使用用户的主组和附加组，否则Group必须是用户所属的组
+type RunAs struct {
+	User  string `json:"user"`
+	Group string `json:"group"`
+}
+
+// 任务进程的资源限制，软限制和硬限制相同，为0表示不限制
+// Cpu为CPU时间的秒数，Nofile为打开文件的数量，As为地址空间的字节数，Nproc为执行用户的进程数
+type Rlimits struct {
+	Cpu    int64 `json:"cpu"`
+	Nofile int64 `json:"nofile"`
+	As     int64 `json:"as"`
+	Nproc  int64 `json:"nproc"`
+}
+
+// 任务每一次执行所在的cgroup v2的资源限制，为0表示不限制
+// MemoryMax为内存上限的字节数，CpuMax为可以使用的CPU核数(可以是小数)，PidsMax为进程数上限
+type CgroupLimits struct {
+	MemoryMax int64   `json:"memory_max"`
+	CpuMax    float64 `json:"cpu_max"`
+	PidsMax   int64   `json:"pids_max"`
+}
+
+// http类型任务发送的请求
+// 响应的状态码在ExpectStatus中时任务执行成功，ExpectStatus为空时2xx都认为成功
+type HttpRequest struct {
+	// 请求方法，默认为GET
+	Method string `json:"method"`
+	// 请求地址
+	Url string `json:"url"`
+	// 请求头
+	Headers map[string]string `json:"headers"`
+	// 请求体
+	Body string `json:"body"`
+	// 期望的响应状态码
+	ExpectStatus []int `json:"expect_status"`
+}
+
+// 任务失败重试策略
+// 任务执行失败后，worker会依据这个策略重新执行任务，重试的执行保持原有的计划时间
+type RetryPolicy struct {
+	// 最大尝试次数，包括第一次执行
+	MaxAttempts int `json:"max_attempts"`
+	// 退避方式，见RetryBackoffXxx枚举，默认为固定间隔
+	Backoff string `json:"backoff"`
+	// 重试间隔，单位为秒。指数退避时表示第一次重试的间隔
+	Interval int `json:"interval"`
+	// 指数退避时的最大间隔，单位为秒，为0表示不限制
+	MaxInterval int `json:"max_interval"`
+	// 只有退出码在这个列表中时才重试，为空表示任何失败都重试
+	ExitCodes []int `json:"exit_codes"`
+}
+
+// 日历，保存了一组日期和时间窗口，job可以引用日历来限制调度执行的时间
+// 日期的格式为"2006-01-02"，日期和固定窗口都在Timezone时区中计算
+type Calendar struct {
+	// 日历名称
+	Name string `json:"name"`
+	// 日历的说明
+	Description string `json:"description"`
+	// 计算日期和窗口使用的IANA时区，为空时使用本机时区
+	Timezone string `json:"timezone"`
+	// 日历包含的日期，例如节假日
+	Dates []string `json:"dates"`
+	// 日历包含的时间窗口，例如变更冻结期
+	Windows []*CalendarWindow `json:"windows"`
+}
+
+// 日历的时间窗口，窗口包含开始时间，不包含结束时间
+// 设置了CronExpr时为周期窗口，每次在CronExpr的时间开始，持续Duration秒
+// 否则为固定窗口，Start和End的格式为"2006-01-02 15:04:05"
+type CalendarWindow struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	CronExpr string `json:"cron_expr"`
+	Duration int    `json:"duration"`
+}
+
+// 手动触发job执行的信息，由master写入etcd，worker收到后立即执行一次job
+// TriggeredBy表示触发者，TriggerTime为触发的毫秒时间戳
+// 由工作流触发时，Workflow和WorkflowRunID为工作流名称和工作流运行的ID，worker执行结束后需要上报结果
+type JobTrigger struct {
+	TriggeredBy   string `json:"triggered_by"`
+	TriggerTime   int64  `json:"trigger_time"`
+	Workflow      string `json:"workflow"`
+	WorkflowRunID string `json:"workflow_run_id"`
+}
+
+// 工作流，由已有的job组成的有向无环图
+// Jobs为工作流中的所有job名称，每个job在工作流中只能出现一次；没有上游的job会在工作流开始时执行
+// CronExpr不为空时，master会在每个计划时间开始一次工作流运行，Timezone为计算它使用的IANA时区
+type Workflow struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Jobs        []string        `json:"jobs"`
+	Edges       []*WorkflowEdge `json:"edges"`
+	CronExpr    string          `json:"cron_expr"`
+	Timezone    string          `json:"timezone"`
+}
+
+// 工作流中的边，From执行结束后，如果结果满足Condition，To才可能执行
+// 一个job的所有上游都结束并且所有入边的条件都满足时，这个job才会执行，否则被跳过
+type WorkflowEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// 触发条件，见WorkflowOnXxx枚举，默认为success
+	Condition string `json:"condition"`
+}
+
+// 工作流的一次运行，时间均为毫秒时间戳
+type WorkflowRun struct {
+	ID          string                        `json:"id"`
+	Workflow    *Workflow                     `json:"workflow"`
+	Status      string                        `json:"status"`
+	TriggeredBy string                        `json:"triggered_by"`
+	StartTime   int64                         `json:"start_time"`
+	EndTime     int64                         `json:"end_time"`
+	Nodes       map[string]*WorkflowNodeState `json:"nodes"`
+}
+
+// 工作流运行中一个节点(job)的状态，Status见WorkflowStatusXxx枚举
+// 节点执行结束后，由执行它的worker上报JobStatus、ExitCode等执行结果
+type WorkflowNodeState struct {
+	Status    string `json:"status"`
+	JobStatus string `json:"job_status"`
+	ExitCode  int    `json:"exit_code"`
+	Err       string `json:"err"`
+	WorkerID  string `json:"worker_id"`
+	StartTime int64  `json:"start_time"`
+	EndTime   int64  `json:"end_time"`
+}
+
+// 错过执行的处理策略
+// 所有worker都停机，或者调度器因为负载过高没有及时执行job时，job的计划时间会被错过
+// 计划时间距离发现时超过Threshold秒的执行被认为是错过的执行，按照Policy处理
+type MisfirePolicy struct {
+	// 处理策略，见MisfireXxx枚举，默认为跳过
+	Policy string `json:"policy"`
+	// 错过执行的阈值，单位为秒，为0时使用默认值5秒
+	Threshold int `json:"threshold"`
+	// run_all策略最多补执行的次数，为0时使用默认值10
+	Limit int `json:"limit"`
 }
 
 // Job事件结构体，保存了事件类型和产生事件对应的job指针
+// 手动触发事件还会保存触发信息Trigger
+// 强杀事件的RunID不为空时，只中断这一次执行，否则中断job所有正在执行的实例
+// 更新事件会保存job上一次被执行的计划时间LastFireTime(毫秒时间戳，没有记录时为0)，用于发现错过的执行
+// 日历事件的Job为nil，Calendar保存了变化的日历(删除事件只有日历名称)
 type JobEvent struct {
-	EventType int
-	Job       *Job
+	EventType    int
+	Job          *Job
+	Trigger      *JobTrigger
+	LastFireTime int64
+	RunCount     int64
+	RunID        string
+	Calendar     *Calendar
 }
 
+// Job执行日志，由执行job的worker生成并写入mongodb
+// 时间均为毫秒时间戳，Timezone为计算计划时间使用的时区；UserTime和SystemTime为进程的CPU时间，单位为毫秒；MaxRss单位为KB
+// Signal为终止进程的信号编号，进程正常退出时为0；WorkerID为执行这次job的worker标识
+// HttpStatus为http类型任务响应的状态码，其它类型的任务为0
+// 在cgroup中执行时，MemoryPeak为cgroup的内存使用峰值，单位为Byte；CpuUsage为cgroup的CPU时间，单位为毫秒
+// 手动触发的执行Manual为true，TriggeredBy为触发者
+// 输出超过上限被截断时，XxxTruncated为true，输出中间会插入截断标记
+// 因为日历的限制而跳过的执行，Status为skipped，SkipReason为跳过的原因
+// 由工作流触发的执行，Workflow和WorkflowRunID为工作流名称和工作流运行的ID
 type JobLog struct {
 	JobName          string `json:"job_name" bson:"job_name"`
 	Command          string `json:"command" bson:"command"`
 	Err              string `json:"err" bson:"err"`
-	Output           string `json:"output" bson:"output"`
+	Stdout           string `json:"stdout" bson:"stdout"`
+	Stderr           string `json:"stderr" bson:"stderr"`
+	StdoutTruncated  bool   `json:"stdout_truncated" bson:"stdout_truncated"`
+	StderrTruncated  bool   `json:"stderr_truncated" bson:"stderr_truncated"`
 	PlanTime         int64  `json:"plan_time" bson:"plan_time"`
+	Timezone         string `json:"timezone" bson:"timezone"`
 	ScheduleTime     int64  `json:"schedule_time" bson:"schedule_time"`
 	ExecuteStartTime int64  `json:"exec_start_time" bson:"exec_start_time"`
 	ExecuteEndTime   int64  `json:"exec_end_time" bson:"exec_end_time"`
+	TimedOut         bool   `json:"timed_out" bson:"timed_out"`
+	Attempt          int    `json:"attempt" bson:"attempt"`
+	Status           string `json:"status" bson:"status"`
+	ExitCode         int    `json:"exit_code" bson:"exit_code"`
+	HttpStatus       int    `json:"http_status" bson:"http_status"`
+	Signal           int    `json:"signal" bson:"signal"`
+	UserTime         int64  `json:"user_time" bson:"user_time"`
+	SystemTime       int64  `json:"system_time" bson:"system_time"`
+	MaxRss           int64  `json:"max_rss" bson:"max_rss"`
+	MemoryPeak       int64  `json:"memory_peak" bson:"memory_peak"`
+	CpuUsage         int64  `json:"cpu_usage" bson:"cpu_usage"`
+	WorkerID         string `json:"worker_id" bson:"worker_id"`
+	Manual           bool   `json:"manual" bson:"manual"`
+	TriggeredBy      string `json:"triggered_by" bson:"triggered_by"`
+	SkipReason       string `json:"skip_reason" bson:"skip_reason"`
+	Workflow         string `json:"workflow" bson:"workflow"`
+	WorkflowRunID    string `json:"workflow_run_id" bson:"workflow_run_id"`
+}
+
+// 运行中job的一段输出，由worker实时推送到etcd，master读取后推送给客户端
+// Stream表示输出来源，为"stdout"或"stderr"；Eof为true表示这次运行已经结束
+// Stopped为true表示输出超过了推送的上限，之后的输出不再推送，只保存在job log中
+type JobOutputChunk struct {
+	Stream  string `json:"stream"`
+	Data    string `json:"data"`
+	Eof     bool   `json:"eof"`
+	Stopped bool   `json:"stopped"`
+}
+
+// 字段校验错误，Field为出错的字段名称，Message为错误信息
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// 一次执行被kill的结果，由执行它的worker写入etcd
+// Signal为最后向进程组发送的信号，没有进程的job(例如http类型)或者进程在kill之前已经退出时为空
+// Exited表示进程组(以及cgroup)中的所有进程都已经退出；KilledAt和ExitedAt为毫秒时间戳
+type JobKillReport struct {
+	JobName  string `json:"job_name"`
+	RunID    string `json:"run_id"`
+	WorkerID string `json:"worker_id"`
+	Signal   string `json:"signal"`
+	Exited   bool   `json:"exited"`
+	KilledAt int64  `json:"killed_at"`
+	ExitedAt int64  `json:"exited_at"`
+}
+
+// kill job的返回结果
+// Running为发出kill时job正在执行的实例数，Reports为等待期间收到的kill结果，数量可能少于Running
+type JobKillResult struct {
+	Running int              `json:"running"`
+	Reports []*JobKillReport `json:"reports"`
+}
+
+// 保存job的返回结果
+// OldJob为被替代的job，新增时为null；NextTimes为job接下来几次执行的毫秒时间戳
+type JobSaveResult struct {
+	OldJob    *Job    `json:"old_job"`
+	NextTimes []int64 `json:"next_times"`
+}
+
+// 执行日历中的一个时刻，Time为毫秒时间戳，Jobs为在这个时刻执行的job名称
+type ScheduleSlot struct {
+	Time int64    `json:"time"`
+	Jobs []string `json:"jobs"`
 }
 
 // Http API返回的所有数据都遵循这个结构
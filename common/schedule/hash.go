@@ -0,0 +1,130 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// cron表达式每个字段的取值范围，H会在这个范围内取值
+// 日期字段最大只取到28，保证每个月都能执行
+type fieldRange struct {
+	name string
+	min  int
+	max  int
+}
+
+var (
+	secondRange = fieldRange{"second", 0, 59}
+	minuteRange = fieldRange{"minute", 0, 59}
+	hourRange   = fieldRange{"hour", 0, 23}
+	domRange    = fieldRange{"day of month", 1, 28}
+	monthRange  = fieldRange{"month", 1, 12}
+	dowRange    = fieldRange{"day of week", 0, 6}
+	yearRange   = fieldRange{"year", 0, -1}
+)
+
+// 把cron表达式中的H替换为由key(通常是job名称)决定的固定值
+// 这样多个写着相同表达式的job会分散在不同的时间执行，而同一个job每次计算的结果都相同
+// 支持以下写法，可以和普通的值一起出现在逗号分隔的列表中：
+//     H: 字段范围内的一个固定值
+//     H/n: 从字段范围内[0, n)的一个固定偏移开始，每n执行一次
+//     H(a-b): a到b之间的一个固定值
+//     H(a-b)/n: 从a开始[0, n)的一个固定偏移开始，到b为止每n执行一次
+// 表达式字段数和cronexpr一致：5个字段为分 时 日 月 周，6个字段在最后加上年，7个字段在最前面加上秒
+// 年字段不支持H；以@开头的预定义表达式原样返回
+func ExpandHash(cronExpr string, key string) (string, error) {
+
+	expr := strings.TrimSpace(cronExpr)
+	if !strings.Contains(expr, "H") || strings.HasPrefix(expr, "@") {
+		return cronExpr, nil
+	}
+
+	fields := strings.Fields(expr)
+	var ranges []fieldRange
+	switch len(fields) {
+	case 5:
+		ranges = []fieldRange{minuteRange, hourRange, domRange, monthRange, dowRange}
+	case 6:
+		ranges = []fieldRange{minuteRange, hourRange, domRange, monthRange, dowRange, yearRange}
+	case 7:
+		ranges = []fieldRange{secondRange, minuteRange, hourRange, domRange, monthRange, dowRange, yearRange}
+	default:
+		return "", fmt.Errorf("syntax error in cron expression: %d fields", len(fields))
+	}
+
+	for i, field := range fields {
+		if !strings.Contains(field, "H") {
+			continue
+		}
+		if ranges[i] == yearRange {
+			return "", errors.New("H is not supported in year field")
+		}
+
+		items := strings.Split(field, ",")
+		for j, item := range items {
+			if !strings.HasPrefix(item, "H") {
+				continue
+			}
+			expanded, err := expandHashItem(item, ranges[i], hashOf(key, i))
+			if err != nil {
+				return "", err
+			}
+			items[j] = expanded
+		}
+		fields[i] = strings.Join(items, ",")
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// 展开一个以H开头的字段项，hash决定了取值
+func expandHashItem(item string, field fieldRange, hash uint32) (string, error) {
+
+	low, high := field.min, field.max
+	rest := item[1:]
+
+	// H(a-b)，限定取值范围
+	if strings.HasPrefix(rest, "(") {
+		end := strings.Index(rest, ")")
+		if end < 0 {
+			return "", fmt.Errorf("syntax error in %s field: '%s'", field.name, item)
+		}
+		bounds := strings.SplitN(rest[1:end], "-", 2)
+		if len(bounds) != 2 {
+			return "", fmt.Errorf("syntax error in %s field: '%s'", field.name, item)
+		}
+		var err1, err2 error
+		low, err1 = strconv.Atoi(bounds[0])
+		high, err2 = strconv.Atoi(bounds[1])
+		if err1 != nil || err2 != nil || low < field.min || high > field.max || low > high {
+			return "", fmt.Errorf("invalid range in %s field: '%s'", field.name, item)
+		}
+		rest = rest[end+1:]
+	}
+
+	if rest == "" {
+		return strconv.Itoa(low + int(hash%uint32(high-low+1))), nil
+	}
+
+	// H/n，每n执行一次
+	if !strings.HasPrefix(rest, "/") {
+		return "", fmt.Errorf("syntax error in %s field: '%s'", field.name, item)
+	}
+	step, err := strconv.Atoi(rest[1:])
+	if err != nil || step <= 0 || step > high-low+1 {
+		return "", fmt.Errorf("invalid step in %s field: '%s'", field.name, item)
+	}
+
+	start := low + int(hash%uint32(step))
+	return fmt.Sprintf("%d-%d/%d", start, high, step), nil
+}
+
+// 由key和字段位置计算哈希值，使同一个job不同字段的取值互不相关
+func hashOf(key string, field int) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key + "#" + strconv.Itoa(field)))
+	return h.Sum32()
+}
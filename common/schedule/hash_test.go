@@ -0,0 +1,55 @@
+package schedule
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExpandHash(t *testing.T) {
+
+	expr, err := ExpandHash("H H/2 * * *", "backup")
+	if err != nil {
+		t.Fatalf("Error ExpandHash: %v", err)
+	}
+	again, _ := ExpandHash("H H/2 * * *", "backup")
+	if expr != again {
+		t.Errorf("Error ExpandHash: not stable, %s != %s", expr, again)
+	}
+
+	fields := strings.Fields(expr)
+	if minute, err := strconv.Atoi(fields[0]); err != nil || minute < 0 || minute > 59 {
+		t.Errorf("Error ExpandHash: minute field %s", fields[0])
+	}
+	if fields[1] != "0-23/2" && fields[1] != "1-23/2" {
+		t.Errorf("Error ExpandHash: hour field %s", fields[1])
+	}
+
+	expr, err = ExpandHash("H(10-20) * * * THU", "report")
+	if err != nil {
+		t.Fatalf("Error ExpandHash: %v", err)
+	}
+	fields = strings.Fields(expr)
+	if minute, err := strconv.Atoi(fields[0]); err != nil || minute < 10 || minute > 20 {
+		t.Errorf("Error ExpandHash: minute field %s", fields[0])
+	}
+	if fields[4] != "THU" {
+		t.Errorf("Error ExpandHash: day of week field %s", fields[4])
+	}
+
+	// 不同的job应该分散到不同的时间
+	minutes := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		expr, _ := ExpandHash("H * * * *", "job-"+strconv.Itoa(i))
+		minutes[strings.Fields(expr)[0]] = true
+	}
+	if len(minutes) < 5 {
+		t.Errorf("Error ExpandHash: jobs not spread, %v", minutes)
+	}
+
+	for _, bad := range []string{"H(50-10) * * * *", "H/0 * * * *", "Hx * * * *", "0 0 * * * H"} {
+		if _, err := ExpandHash(bad, "bad"); err == nil {
+			t.Errorf("Error ExpandHash: expect error for '%s'", bad)
+		}
+	}
+}
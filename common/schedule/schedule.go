@@ -0,0 +1,213 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+	"github.com/gorhill/cronexpr"
+)
+
+// Job的调度表达式，决定了job在什么时间执行
+// worker的调度和master的执行时间预览都通过这个结构计算执行时间，保证二者的结果一致
+// cron表达式在job指定的时区中计算，没有指定时区时使用本机时区
+// kind为job的调度方式，见ScheduleXxx枚举，只有cron方式使用expr：
+//     once: 只在runAt执行一次
+//     every: 每隔interval执行一次，执行时间对齐到interval的整数倍，所有worker计算出的时间相同
+//     delay_after_finish: 执行时间为上一次执行结束的interval之后，from需要传入上一次执行结束的时间
+// start和end为job调度的时间范围，范围之外的计划时间不会执行，零值时间表示不限制
+type Schedule struct {
+	kind     string
+	expr     *cronexpr.Expression
+	runAt    time.Time
+	interval time.Duration
+	start    time.Time
+	end      time.Time
+	location *time.Location
+}
+
+// 解析job的调度表达式，如果表达式或者时区解析失败，会返回错误
+// 表达式中的H会依据job名称展开，见ExpandHash
+func Parse(job *protocol.Job) (*Schedule, error) {
+
+	schedule, err := parse(job)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.StartAt > 0 {
+		schedule.start = fromMilli(job.StartAt, schedule.location)
+	}
+	if job.EndAt > 0 {
+		schedule.end = fromMilli(job.EndAt, schedule.location)
+	}
+	return schedule, nil
+}
+
+// 依据job的调度方式解析调度表达式
+func parse(job *protocol.Job) (*Schedule, error) {
+
+	location, err := LoadLocation(job.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	switch job.ScheduleType {
+	case "", protocol.ScheduleCron:
+	case protocol.ScheduleOnce:
+		if job.RunAt <= 0 {
+			return nil, errors.New("run_at is required")
+		}
+		runAt := fromMilli(job.RunAt, location)
+		return &Schedule{kind: job.ScheduleType, runAt: runAt, location: location}, nil
+	case protocol.ScheduleEvery, protocol.ScheduleDelayAfterFinish:
+		if job.Interval <= 0 {
+			return nil, errors.New("interval must be positive")
+		}
+		interval := time.Duration(job.Interval) * time.Second
+		return &Schedule{kind: job.ScheduleType, interval: interval, location: location}, nil
+	default:
+		return nil, fmt.Errorf("unknown schedule type '%s'", job.ScheduleType)
+	}
+
+	cronExpr, err := ExpandHash(job.CronExpr, job.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	expr, err := cronexpr.Parse(cronExpr)
+	if err != nil {
+		return nil, err
+	}
+	return &Schedule{kind: protocol.ScheduleCron, expr: expr, location: location}, nil
+}
+
+// 加载IANA时区，例如"Asia/Shanghai"，name为""时返回本机时区
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// 调度表达式使用的时区
+func (schedule *Schedule) Location() *time.Location {
+	return schedule.location
+}
+
+// 调度方式，见ScheduleXxx枚举
+func (schedule *Schedule) Kind() string {
+	return schedule.kind
+}
+
+// 返回from之后的下一次执行时间，如果没有下一次执行，返回零值时间
+// 下一次执行时间不会早于job开始调度的时间，超过了job结束调度的时间时返回零值时间
+func (schedule *Schedule) Next(from time.Time) time.Time {
+
+	// 从开始调度之前计算时，开始调度的时间本身也可以执行
+	if !schedule.start.IsZero() && from.Before(schedule.start) {
+		from = schedule.start.Add(-time.Nanosecond)
+	}
+
+	next := schedule.next(from)
+	if !schedule.end.IsZero() && next.After(schedule.end) {
+		return time.Time{}
+	}
+	return next
+}
+
+// 不考虑调度时间范围，返回from之后的下一次执行时间
+//
+// cron表达式描述的是时区中的墙上时间，而夏令时切换时墙上时间并不连续，
+// 因此这里先把时间转换为没有夏令时的UTC墙上时间来匹配表达式，再转换回时区中的真实时间：
+//     1. 被跳过的时间(例如夏令时开始时的2:30)不存在，会在跳过的时长之后执行，即3:30
+//     2. 重复的时间(例如夏令时结束时的1:30)只会在第一次出现时执行一次
+func (schedule *Schedule) next(from time.Time) time.Time {
+
+	switch schedule.kind {
+	case protocol.ScheduleOnce:
+		if schedule.runAt.After(from) {
+			return schedule.runAt
+		}
+		return time.Time{}
+	case protocol.ScheduleEvery:
+		n := from.UnixNano()
+		next := n - n%int64(schedule.interval) + int64(schedule.interval)
+		return time.Unix(0, next).In(schedule.location)
+	case protocol.ScheduleDelayAfterFinish:
+		return from.Add(schedule.interval).In(schedule.location)
+	}
+
+	wall := toWall(from.In(schedule.location))
+	for {
+		wall = schedule.expr.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+
+		next := fromWall(wall, schedule.location)
+		if next.After(from) {
+			return next
+		}
+	}
+}
+
+// 返回从from开始(不包括from)的n次执行时间
+func (schedule *Schedule) NextN(from time.Time, n int) []time.Time {
+	return schedule.Between(from, time.Time{}, n)
+}
+
+// 返回(from, to]之间的执行时间，最多返回limit个。to为零值时间表示不限制结束时间
+func (schedule *Schedule) Between(from time.Time, to time.Time, limit int) []time.Time {
+
+	fireTimes := make([]time.Time, 0)
+	for len(fireTimes) < limit {
+		from = schedule.Next(from)
+		if from.IsZero() || (!to.IsZero() && from.After(to)) {
+			break
+		}
+		fireTimes = append(fireTimes, from)
+	}
+	return fireTimes
+}
+
+// 把毫秒时间戳转换为时区中的时间
+func fromMilli(milli int64, location *time.Location) time.Time {
+	return time.Unix(0, milli*int64(time.Millisecond)).In(location)
+}
+
+// 把时区中的时间转换为相同墙上时间的UTC时间
+func toWall(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// 把UTC墙上时间转换为时区中的真实时间
+// 墙上时间重复时，返回第一次出现的时间；墙上时间不存在时(被夏令时跳过)，
+// 使用切换前的时区偏移计算，结果会落在跳过的时长之后
+func fromWall(wall time.Time, location *time.Location) time.Time {
+
+	// 时区偏移的范围在-12到+14小时之间，因此真实时间一定在这两个时刻之间，
+	// 分别取这两个时刻的偏移作为切换前后的候选偏移
+	_, beforeOffset := wall.Add(-14 * time.Hour).In(location).Zone()
+	_, afterOffset := wall.Add(14 * time.Hour).In(location).Zone()
+
+	before := wall.Add(-time.Duration(beforeOffset) * time.Second).In(location)
+	after := wall.Add(-time.Duration(afterOffset) * time.Second).In(location)
+
+	beforeValid := toWall(before).Equal(wall)
+	afterValid := toWall(after).Equal(wall)
+
+	switch {
+	case beforeValid && afterValid:
+		if after.Before(before) {
+			return after
+		}
+		return before
+	case afterValid:
+		return after
+	default:
+		return before
+	}
+}
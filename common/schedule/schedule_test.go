@@ -0,0 +1,150 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestSchedule(t *testing.T) {
+
+	schedule, err := Parse(&protocol.Job{Name: "hourly", CronExpr: "0 * * * *"})
+	if err != nil {
+		t.Fatalf("Error Parse: %v", err)
+	}
+
+	from := time.Date(2020, 2, 1, 10, 30, 0, 0, time.Local)
+	fireTimes := schedule.NextN(from, 5)
+	if len(fireTimes) != 5 || !fireTimes[0].Equal(
+		time.Date(2020, 2, 1, 11, 0, 0, 0, time.Local)) {
+		t.Errorf("Error NextN: %v", fireTimes)
+	}
+
+	to := time.Date(2020, 2, 1, 14, 0, 0, 0, time.Local)
+	fireTimes = schedule.Between(from, to, 100)
+	if len(fireTimes) != 4 || !fireTimes[3].Equal(to) {
+		t.Errorf("Error Between: %v", fireTimes)
+	}
+
+	if _, err := Parse(&protocol.Job{Name: "bad", CronExpr: "* * *"}); err == nil {
+		t.Errorf("Error Parse: invalid expression accepted")
+	}
+}
+
+func TestScheduleTimezone(t *testing.T) {
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+
+	// 2020-03-08 2:00 夏令时开始，2:30被跳过，会在3:30执行
+	schedule, _ := Parse(&protocol.Job{CronExpr: "30 2 * * *", Timezone: "America/New_York"})
+	fireTimes := schedule.NextN(time.Date(2020, 3, 7, 12, 0, 0, 0, newYork), 2)
+	if !fireTimes[0].Equal(time.Date(2020, 3, 8, 3, 30, 0, 0, newYork)) ||
+		!fireTimes[1].Equal(time.Date(2020, 3, 9, 2, 30, 0, 0, newYork)) {
+		t.Errorf("Error skipped hour: %v", fireTimes)
+	}
+
+	// 2020-11-01 2:00 夏令时结束，1:00-2:00重复，重复的时间只执行一次
+	schedule, _ = Parse(&protocol.Job{CronExpr: "*/30 * * * *", Timezone: "America/New_York"})
+	fireTimes = schedule.NextN(time.Date(2020, 11, 1, 0, 40, 0, 0, newYork), 4)
+	expected := []string{"01:00 EDT", "01:30 EDT", "02:00 EST", "02:30 EST"}
+	for i, fireTime := range fireTimes {
+		if fireTime.Format("15:04 MST") != expected[i] {
+			t.Errorf("Error repeated hour: %v", fireTimes)
+			break
+		}
+	}
+
+	// 在重复的第二个小时中计算，不会回到第一次出现的时间
+	from := time.Date(2020, 11, 1, 6, 10, 0, 0, time.UTC) // 01:10 EST
+	if next := schedule.Next(from); next.Format("15:04 MST") != "02:00 EST" {
+		t.Errorf("Error repeated hour: %v", next.In(newYork))
+	}
+
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	schedule, _ = Parse(&protocol.Job{CronExpr: "0 9 * * *", Timezone: "Asia/Shanghai"})
+	next := schedule.Next(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2020, 2, 1, 9, 0, 0, 0, shanghai)) {
+		t.Errorf("Error Asia/Shanghai: %v", next)
+	}
+
+	if _, err := Parse(&protocol.Job{CronExpr: "* * * * *", Timezone: "Mars/Olympus"}); err == nil {
+		t.Errorf("Error Parse: invalid time zone accepted")
+	}
+}
+
+func TestScheduleOnce(t *testing.T) {
+
+	runAt := time.Date(2026, 11, 1, 3, 0, 0, 0, time.Local)
+	schedule, err := Parse(&protocol.Job{Name: "once",
+		ScheduleType: protocol.ScheduleOnce, RunAt: runAt.UnixNano() / 1000 / 1000})
+	if err != nil {
+		t.Fatalf("Error Parse: %v", err)
+	}
+	if schedule.Kind() != protocol.ScheduleOnce {
+		t.Errorf("Error Kind: %s", schedule.Kind())
+	}
+
+	fireTimes := schedule.NextN(runAt.Add(-time.Hour), 5)
+	if len(fireTimes) != 1 || !fireTimes[0].Equal(runAt) {
+		t.Errorf("Error NextN: %v", fireTimes)
+	}
+	if next := schedule.Next(runAt); !next.IsZero() {
+		t.Errorf("Error Next: %v", next)
+	}
+
+	if _, err := Parse(&protocol.Job{Name: "bad", ScheduleType: protocol.ScheduleOnce}); err == nil {
+		t.Errorf("Error Parse: missing run_at accepted")
+	}
+	if _, err := Parse(&protocol.Job{Name: "bad", ScheduleType: "weekly"}); err == nil {
+		t.Errorf("Error Parse: unknown schedule type accepted")
+	}
+}
+
+func TestScheduleInterval(t *testing.T) {
+
+	every, err := Parse(&protocol.Job{Name: "every",
+		ScheduleType: protocol.ScheduleEvery, Interval: 90})
+	if err != nil {
+		t.Fatalf("Error Parse: %v", err)
+	}
+
+	from := time.Unix(1000, 0)
+	fireTimes := every.NextN(from, 3)
+	if len(fireTimes) != 3 || fireTimes[0].Unix() != 1080 || fireTimes[2].Unix() != 1260 {
+		t.Errorf("Error NextN: %v", fireTimes)
+	}
+
+	delay, err := Parse(&protocol.Job{Name: "delay",
+		ScheduleType: protocol.ScheduleDelayAfterFinish, Interval: 90})
+	if err != nil {
+		t.Fatalf("Error Parse: %v", err)
+	}
+	if next := delay.Next(from); next.Unix() != 1090 {
+		t.Errorf("Error Next: %v", next)
+	}
+
+	if _, err := Parse(&protocol.Job{Name: "bad", ScheduleType: protocol.ScheduleEvery}); err == nil {
+		t.Errorf("Error Parse: missing interval accepted")
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+
+	start := time.Date(2020, 2, 1, 12, 0, 0, 0, time.Local)
+	end := time.Date(2020, 2, 1, 15, 0, 0, 0, time.Local)
+	schedule, err := Parse(&protocol.Job{Name: "campaign", CronExpr: "0 * * * *",
+		StartAt: start.UnixNano() / 1000 / 1000, EndAt: end.UnixNano() / 1000 / 1000})
+	if err != nil {
+		t.Fatalf("Error Parse: %v", err)
+	}
+
+	from := time.Date(2020, 2, 1, 10, 30, 0, 0, time.Local)
+	fireTimes := schedule.NextN(from, 10)
+	if len(fireTimes) != 4 || !fireTimes[0].Equal(start) || !fireTimes[3].Equal(end) {
+		t.Errorf("Error NextN: %v", fireTimes)
+	}
+}
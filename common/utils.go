@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +20,25 @@ func IntSecond(t int) time.Duration {
 	return time.Duration(t) * time.Second
 }
 
+// 将时间转换为毫秒时间戳
+func ToMilli(t time.Time) int64 {
+	return t.UnixNano() / 1000 / 1000
+}
+
+// 将毫秒时间戳转换为时间
+func FromMilli(milli int64) time.Time {
+	return time.Unix(0, milli*1000*1000)
+}
+
+// 将时间列表转换为毫秒时间戳列表
+func MilliTimes(times []time.Time) []int64 {
+	millis := make([]int64, 0, len(times))
+	for _, t := range times {
+		millis = append(millis, ToMilli(t))
+	}
+	return millis
+}
+
 // 将地址和端口转换为标准的host地址输出
 func GetHost(addr string, port int) string {
 	return fmt.Sprintf("%s:%d", addr, port)
@@ -47,6 +67,33 @@ func GetJobNameFromKill(kv *mvccpb.KeyValue) string {
 	return strings.TrimPrefix(string(kv.Key), JobKillPrefix)
 }
 
+// 从KV run中的key取得job名称
+func GetJobNameFromRun(kv *mvccpb.KeyValue) string {
+	return strings.TrimPrefix(string(kv.Key), JobRunPrefix)
+}
+
+// 从KV fired中取得job名称和上一次执行的计划时间(毫秒时间戳)，value解析失败时时间为0
+func GetLastFireTimeFromKv(kv *mvccpb.KeyValue) (string, int64) {
+	lastFireTime, _ := strconv.ParseInt(string(kv.Value), 10, 64)
+	return strings.TrimPrefix(string(kv.Key), JobFiredPrefix), lastFireTime
+}
+
+// 从KV calendar中的Value获取日历对象，解析失败时返回nil
+func GetCalendarFromKv(kv *mvccpb.KeyValue) *protocol.Calendar {
+
+	var calendar protocol.Calendar
+	if err := json.Unmarshal(kv.Value, &calendar); err != nil {
+		return nil
+	}
+
+	return &calendar
+}
+
+// 从KV calendar中的key取得日历名称
+func GetCalendarNameFromKv(kv *mvccpb.KeyValue) string {
+	return strings.TrimPrefix(string(kv.Key), CalendarPrefix)
+}
+
 // 从KV worker中的key取得worker ID
 func GetIDFromWorker(kv *mvccpb.KeyValue) string {
 	return strings.TrimPrefix(string(kv.Key), JobWorkerPrefix)
@@ -1,6 +1,8 @@
 package master
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +10,8 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golazycat/lazycron/common/joblog"
 
@@ -16,6 +20,7 @@ import (
 	"github.com/golazycat/lazycron/common"
 	"github.com/golazycat/lazycron/common/logs"
 	"github.com/golazycat/lazycron/common/protocol"
+	"github.com/golazycat/lazycron/common/schedule"
 )
 
 const (
@@ -24,8 +29,17 @@ const (
 	JobManagerErrorNo
 	JobLogErrorNo
 	WorkerManagerErrorNo
+	JobValidationErrorNo
+	CalendarManagerErrorNo
+	WorkflowManagerErrorNo
 )
 
+// 保存job后返回接下来多少次的执行时间
+const saveJobNextTimes = 5
+
+// kill job时默认等待worker上报结果的秒数，需要小于http的写超时时间
+const defaultKillWait = 3
+
 var (
 	// 全局Http server
 	gHttpServer *ApiServer
@@ -53,7 +67,9 @@ type ApiServer struct {
 // }
 //
 // Return:
-// 	  当是覆盖保存时，data为被替代的Job；否则，data为null
+// 	  data.old_job: 当是覆盖保存时，为被替代的Job；否则为null
+// 	  data.next_times: job接下来5次执行的毫秒时间戳
+// 	  如果job校验失败，errno为JobValidationErrorNo，data为每个字段的错误信息
 //
 func handleJobSave(w http.ResponseWriter, r *http.Request) {
 
@@ -71,11 +87,19 @@ func handleJobSave(w http.ResponseWriter, r *http.Request) {
 
 	oldJob, err := JobManager.SaveJob(&job)
 	if err != nil {
+		if validation, ok := err.(*JobValidationError); ok {
+			protocol.HttpFail(w, JobValidationErrorNo,
+				validation.Error(), validation.Errors)
+			return
+		}
 		jobManagerError(w, "save", err)
 		return
 	}
 
-	protocol.HttpSuccess(w, oldJob)
+	protocol.HttpSuccess(w, &protocol.JobSaveResult{
+		OldJob:    oldJob,
+		NextTimes: nextFireTimes(&job, time.Now(), saveJobNextTimes),
+	})
 }
 
 // 删除任务
@@ -115,24 +139,258 @@ func handleJobList(w http.ResponseWriter, _ *http.Request) {
 }
 
 // 强制杀死某个任务
-// 参数同删除任务
-// 这个Api仅仅会发送命令，不关心命令的执行结果，命令会由worker执行
-// 因此当返回成功时，仅表示命令成功被发送，不表示任务真的被杀死
+// Method: POST
+// Request Body:
+//     name: 要kill的job的名称
+//     wait: 等待worker上报kill结果的秒数，可选，默认为3，为0时不等待；最多等待到http写超时之前1秒
+// Return:
+//     data.running: 发出kill时正在执行的实例数
+//     data.reports: 等待期间收到的kill结果，少于running时说明还有实例没有上报
+// kill命令由worker执行，worker会结束任务的整个进程组，然后上报进程是否全部退出
 func handleJobKill(w http.ResponseWriter, r *http.Request) {
 
 	jobName := parseFormAndGet(w, r, "name")
 	if jobName == "" {
 		return
 	}
+	wait := common.IntSecond(getIntValueOrDefault(r.PostForm.Get("wait"), defaultKillWait))
+	// 等待超过写超时会导致响应无法写出，客户端只会看到连接被断开
+	if writeTimeout := gHttpServer.httpServer.WriteTimeout; writeTimeout > 0 && wait > writeTimeout-time.Second {
+		wait = writeTimeout - time.Second
+	}
 
-	err := JobManager.KillJob(jobName)
+	result, err := JobManager.KillJob(jobName, wait)
 	if err != nil {
 		jobManagerError(w, "kill", err)
 		return
 	}
+	protocol.HttpSuccess(w, result)
+}
+
+// 手动执行某个任务
+// Method: POST
+// Request Body:
+//     name: 要执行的任务名称
+//     triggered_by: 触发者，可选，默认为请求的来源地址
+// 和强杀一样，这个Api仅仅会发送命令，命令会由worker执行
+// 因此当返回成功时，仅表示命令成功被发送，执行结果需要通过任务日志查看
+func handleJobRun(w http.ResponseWriter, r *http.Request) {
+
+	jobName := parseFormAndGet(w, r, "name")
+	if jobName == "" {
+		return
+	}
+
+	triggeredBy := r.PostForm.Get("triggered_by")
+	if triggeredBy == "" {
+		triggeredBy = r.RemoteAddr
+	}
+
+	err := JobManager.RunJob(jobName, triggeredBy)
+	if err != nil {
+		jobManagerError(w, "run", err)
+		return
+	}
 	protocol.HttpSuccess(w, nil)
 }
 
+// 暂停某个任务，暂停的任务不会被调度执行，但是仍然可以手动执行
+// Method: POST
+// Request Body:
+//     name: 要暂停的任务名称
+//     reason: 可选，暂停的原因
+// Return:
+//     暂停后的job
+func handleJobPause(w http.ResponseWriter, r *http.Request) {
+
+	jobName := parseFormAndGet(w, r, "name")
+	if jobName == "" {
+		return
+	}
+
+	job, err := JobManager.PauseJob(jobName, r.PostForm.Get("reason"))
+	if err != nil {
+		jobManagerError(w, "pause", err)
+		return
+	}
+	protocol.HttpSuccess(w, job)
+}
+
+// 恢复被暂停的任务
+// 参数同删除任务
+// Return:
+//     恢复后的job
+func handleJobResume(w http.ResponseWriter, r *http.Request) {
+
+	jobName := parseFormAndGet(w, r, "name")
+	if jobName == "" {
+		return
+	}
+
+	job, err := JobManager.ResumeJob(jobName)
+	if err != nil {
+		jobManagerError(w, "resume", err)
+		return
+	}
+	protocol.HttpSuccess(w, job)
+}
+
+// 跟踪job当前运行的输出
+// Method: GET
+// Query:
+//     name: 要跟踪的job名称
+// Return:
+//     job没有在运行时，返回错误json；否则以Server-Sent Events的形式持续返回这次运行的输出，
+//     事件名称为stdout或stderr，data为输出内容。运行结束时返回名称为end的事件并关闭连接
+//     输出超过worker推送的上限时返回名称为stopped的事件，之后只会等待运行结束
+func handleJobTail(w http.ResponseWriter, r *http.Request) {
+
+	if err := parseForm(w, r); err != nil {
+		return
+	}
+	jobName := r.Form.Get("name")
+	if jobName == "" {
+		protocol.HttpFail(w, HttpParamParseErrorNo, "require param name", nil)
+		return
+	}
+
+	cancelCtx, cancelFunc := context.WithCancel(context.TODO())
+	defer cancelFunc()
+
+	chunkChan, err := JobManager.WatchJobOutput(cancelCtx, jobName)
+	if err != nil {
+		jobManagerError(w, "tail", err)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		jobManagerError(w, "tail", errors.New("streaming is not supported"))
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// 输出可能持续很久，接管连接后取消http server设置的读写超时
+	_ = conn.SetDeadline(time.Time{})
+
+	_, _ = rw.WriteString("HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/event-stream\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n\r\n")
+	if rw.Flush() != nil {
+		return
+	}
+
+	// 定时发送心跳，以便及时发现客户端断开连接
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case chunk, ok := <-chunkChan:
+			if !ok || chunk.Eof {
+				_ = writeServerSentEvent(rw, "end", "")
+				return
+			}
+			if chunk.Stopped {
+				if writeServerSentEvent(rw, "stopped", "output exceeds the stream limit, see job log") != nil {
+					return
+				}
+				continue
+			}
+			// 没有Stream的输出段是运行开始的标记
+			if chunk.Stream == "" {
+				continue
+			}
+			if writeServerSentEvent(rw, chunk.Stream, chunk.Data) != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			_, _ = rw.WriteString(": ping\n\n")
+			if rw.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// 预览job的执行时间
+// Method: POST
+// Request Body:
+//     name: 要预览的job名称，和cron_expr二选一
+//     cron_expr: 要预览的cron表达式，和name二选一
+//     timezone: 可选，使用cron_expr预览时计算使用的IANA时区，和job的timezone相同，默认为master本机时区
+//     start: 可选，开始时间的毫秒时间戳，默认为当前时间
+//     end: 可选，结束时间的毫秒时间戳，默认为开始时间之后24小时
+//     limit: 可选，最多返回多少个执行时间，默认为100
+// Return:
+//     data为(start, end]之间的执行时间，毫秒时间戳列表
+func handleJobSchedule(w http.ResponseWriter, r *http.Request) {
+
+	if err := parseForm(w, r); err != nil {
+		return
+	}
+	start, end, limit := parseScheduleWindow(r)
+
+	var job *protocol.Job
+	if name := r.PostForm.Get("name"); name != "" {
+		var err error
+		if job, err = JobManager.GetJob(name); err != nil {
+			jobManagerError(w, "schedule", err)
+			return
+		}
+	} else if cronExpr := r.PostForm.Get("cron_expr"); cronExpr != "" {
+		job = &protocol.Job{CronExpr: cronExpr, Timezone: r.PostForm.Get("timezone")}
+		if _, err := schedule.LoadLocation(job.Timezone); err != nil {
+			protocol.HttpFail(w, JobValidationErrorNo,
+				fmt.Sprintf("unknown time zone '%s'", job.Timezone), nil)
+			return
+		}
+	} else {
+		protocol.HttpFail(w, HttpParamParseErrorNo,
+			"require param name or cron_expr", nil)
+		return
+	}
+
+	jobSchedule, err := schedule.Parse(job)
+	if err != nil {
+		protocol.HttpFail(w, JobValidationErrorNo,
+			fmt.Sprintf("invalid cron expression: %s", err), nil)
+		return
+	}
+
+	protocol.HttpSuccess(w,
+		common.MilliTimes(jobSchedule.Between(start, end, limit)))
+}
+
+// 查看所有job在一段时间内的执行日历
+// Method: POST
+// Request Body:
+//     start, end, limit: 同预览job的执行时间，limit限制每个job最多计算多少个执行时间
+// Return:
+//     data为按时间排序的执行时刻列表，每一项包括time(毫秒时间戳)和jobs(在这个时刻执行的job名称)
+//     被暂停的job不会出现在日历中
+func handleJobCalendar(w http.ResponseWriter, r *http.Request) {
+
+	if err := parseForm(w, r); err != nil {
+		return
+	}
+	start, end, limit := parseScheduleWindow(r)
+
+	slots, err := JobManager.Calendar(start, end, limit)
+	if err != nil {
+		jobManagerError(w, "calendar", err)
+		return
+	}
+
+	protocol.HttpSuccess(w, slots)
+}
+
 // 获取job执行的参数
 // Method: POST
 // Request Body:
@@ -178,6 +436,229 @@ func handleWorkerList(w http.ResponseWriter, r *http.Request) {
 	protocol.HttpSuccess(w, workers)
 }
 
+// 保存日历
+// Method: POST
+// Request Body:
+// calendar: {
+//     "name": "日历名称",
+//     "timezone": "时区",
+//     "dates": ["2006-01-02"],
+//     "windows": [{"start": "2006-01-02 15:04:05", "end": "2006-01-02 15:04:05"},
+//                 {"cron_expr": "周期窗口开始的cron表达式", "duration": 持续的秒数}]
+// }
+// Return:
+//     当是覆盖保存时，data为被替代的日历；否则为null
+//     如果日历校验失败，errno为JobValidationErrorNo，data为每个字段的错误信息
+func handleCalendarSave(w http.ResponseWriter, r *http.Request) {
+
+	postCalendar := parseFormAndGet(w, r, "calendar")
+	if postCalendar == "" {
+		return
+	}
+
+	var cal protocol.Calendar
+	if err := json.Unmarshal([]byte(postCalendar), &cal); err != nil {
+		protocol.HttpFail(w, HttpParamJsonDecodeErrorNo,
+			fmt.Sprintf("calendar decode error: %s", postCalendar), nil)
+		return
+	}
+
+	oldCalendar, err := CalendarManager.SaveCalendar(&cal)
+	if err != nil {
+		if validation, ok := err.(*JobValidationError); ok {
+			protocol.HttpFail(w, JobValidationErrorNo,
+				validation.Error(), validation.Errors)
+			return
+		}
+		calendarManagerError(w, "save", err)
+		return
+	}
+
+	protocol.HttpSuccess(w, oldCalendar)
+}
+
+// 删除日历
+// Method: POST
+// Request Body:
+//    name: 要删除的日历的名称
+// Return:
+//    若删除成功，data保存被删除的日历，日历不存在时data为null
+func handleCalendarDelete(w http.ResponseWriter, r *http.Request) {
+
+	name := parseFormAndGet(w, r, "name")
+	if name == "" {
+		return
+	}
+
+	delCalendar, err := CalendarManager.DeleteCalendar(name)
+	if err != nil {
+		calendarManagerError(w, "del", err)
+		return
+	}
+
+	protocol.HttpSuccess(w, delCalendar)
+}
+
+// 列出所有日历
+// Method: POST
+// Return:
+//     data保存所有日历列表，如果没有日历，data保存空列表
+func handleCalendarList(w http.ResponseWriter, _ *http.Request) {
+
+	calendars, err := CalendarManager.ListCalendars()
+	if err != nil {
+		calendarManagerError(w, "list", err)
+		return
+	}
+
+	protocol.HttpSuccess(w, calendars)
+}
+
+// 保存工作流
+// Method: POST
+// Request Body:
+// workflow: {
+//     "name": "工作流名称",
+//     "jobs": ["job名称"],
+//     "edges": [{"from": "上游job名称", "to": "下游job名称", "condition": "success/failure/always"}],
+//     "cron_expr": "可选，定时运行工作流的cron表达式",
+//     "timezone": "可选，计算cron_expr使用的IANA时区"
+// }
+// Return:
+//     当是覆盖保存时，data为被替代的工作流；否则为null
+//     如果工作流校验失败，errno为JobValidationErrorNo，data为每个字段的错误信息
+func handleWorkflowSave(w http.ResponseWriter, r *http.Request) {
+
+	postWorkflow := parseFormAndGet(w, r, "workflow")
+	if postWorkflow == "" {
+		return
+	}
+
+	var workflow protocol.Workflow
+	if err := json.Unmarshal([]byte(postWorkflow), &workflow); err != nil {
+		protocol.HttpFail(w, HttpParamJsonDecodeErrorNo,
+			fmt.Sprintf("workflow decode error: %s", postWorkflow), nil)
+		return
+	}
+
+	oldWorkflow, err := WorkflowManager.SaveWorkflow(&workflow)
+	if err != nil {
+		if validation, ok := err.(*JobValidationError); ok {
+			protocol.HttpFail(w, JobValidationErrorNo,
+				validation.Error(), validation.Errors)
+			return
+		}
+		workflowManagerError(w, "save", err)
+		return
+	}
+
+	protocol.HttpSuccess(w, oldWorkflow)
+}
+
+// 删除工作流
+// Method: POST
+// Request Body:
+//    name: 要删除的工作流的名称
+// Return:
+//    若删除成功，data保存被删除的工作流，工作流不存在时data为null
+func handleWorkflowDelete(w http.ResponseWriter, r *http.Request) {
+
+	name := parseFormAndGet(w, r, "name")
+	if name == "" {
+		return
+	}
+
+	delWorkflow, err := WorkflowManager.DeleteWorkflow(name)
+	if err != nil {
+		workflowManagerError(w, "del", err)
+		return
+	}
+
+	protocol.HttpSuccess(w, delWorkflow)
+}
+
+// 列出所有工作流
+// Method: POST
+// Return:
+//     data保存所有工作流列表，如果没有工作流，data保存空列表
+func handleWorkflowList(w http.ResponseWriter, _ *http.Request) {
+
+	workflows, err := WorkflowManager.ListWorkflows()
+	if err != nil {
+		workflowManagerError(w, "list", err)
+		return
+	}
+
+	protocol.HttpSuccess(w, workflows)
+}
+
+// 开始工作流的一次运行
+// Method: POST
+// Request Body:
+//     name: 要运行的工作流名称
+//     triggered_by: 触发者，可选，默认为请求的来源地址
+// Return:
+//     data为这次运行，其中id为运行ID，可以用来查询运行的状态
+func handleWorkflowRun(w http.ResponseWriter, r *http.Request) {
+
+	name := parseFormAndGet(w, r, "name")
+	if name == "" {
+		return
+	}
+
+	triggeredBy := r.PostForm.Get("triggered_by")
+	if triggeredBy == "" {
+		triggeredBy = r.RemoteAddr
+	}
+
+	run, err := WorkflowManager.RunWorkflow(name, triggeredBy)
+	if err != nil {
+		workflowManagerError(w, "run", err)
+		return
+	}
+
+	protocol.HttpSuccess(w, run)
+}
+
+// 查询工作流运行的状态
+// Method: POST
+// Request Body:
+//     name: 工作流名称，查询这个工作流的所有运行，和run_id二选一
+//     run_id: 运行ID，查询这一次运行，和name二选一
+// Return:
+//     指定run_id时data为这次运行，否则为运行列表(从新到旧)
+//     运行中的nodes保存了每个job节点的状态
+func handleWorkflowStatus(w http.ResponseWriter, r *http.Request) {
+
+	if err := parseForm(w, r); err != nil {
+		return
+	}
+
+	if runID := r.PostForm.Get("run_id"); runID != "" {
+		run, err := WorkflowManager.GetWorkflowRun(runID)
+		if err != nil {
+			workflowManagerError(w, "status", err)
+			return
+		}
+		protocol.HttpSuccess(w, run)
+		return
+	}
+
+	name := r.PostForm.Get("name")
+	if name == "" {
+		protocol.HttpFail(w, HttpParamParseErrorNo,
+			"require param name or run_id", nil)
+		return
+	}
+
+	runs, err := WorkflowManager.ListWorkflowRuns(name)
+	if err != nil {
+		workflowManagerError(w, "status", err)
+		return
+	}
+	protocol.HttpSuccess(w, runs)
+}
+
 // ApiServer 初始化器
 type ApiServerInitializer struct {
 	Conf *conf.MasterConf
@@ -193,9 +674,27 @@ func (a ApiServerInitializer) Init() error {
 	mux.HandleFunc("/job/del", handleJobDelete)
 	mux.HandleFunc("/job/list", handleJobList)
 	mux.HandleFunc("/job/kill", handleJobKill)
+	mux.HandleFunc("/job/run", handleJobRun)
+	mux.HandleFunc("/job/pause", handleJobPause)
+	mux.HandleFunc("/job/resume", handleJobResume)
 	mux.HandleFunc("/job/log", handleJobLog)
+	mux.HandleFunc("/job/schedule", handleJobSchedule)
+	mux.HandleFunc("/job/calendar", handleJobCalendar)
+	mux.HandleFunc("/job/tail", handleJobTail)
 	mux.HandleFunc("/worker/list", handleWorkerList)
 
+	// calendar api
+	mux.HandleFunc("/calendar/save", handleCalendarSave)
+	mux.HandleFunc("/calendar/del", handleCalendarDelete)
+	mux.HandleFunc("/calendar/list", handleCalendarList)
+
+	// workflow api
+	mux.HandleFunc("/workflow/save", handleWorkflowSave)
+	mux.HandleFunc("/workflow/del", handleWorkflowDelete)
+	mux.HandleFunc("/workflow/list", handleWorkflowList)
+	mux.HandleFunc("/workflow/run", handleWorkflowRun)
+	mux.HandleFunc("/workflow/status", handleWorkflowStatus)
+
 	// static web root
 	staticDir := http.Dir(a.Conf.StaticWebRoot)
 	staticHandler := http.FileServer(staticDir)
@@ -295,9 +794,65 @@ func getIntValueOrDefault(sVal string, valDefault int) int {
 	return valDefault
 }
 
+// 辅助函数，从表单中取得执行时间预览的时间窗口和数量限制
+// start默认为当前时间，end默认为start之后24小时，limit默认为100，最大为1000
+func parseScheduleWindow(r *http.Request) (time.Time, time.Time, int) {
+
+	start := time.Now()
+	if startMilli := getIntValueOrDefault(r.PostForm.Get("start"), 0); startMilli > 0 {
+		start = common.FromMilli(int64(startMilli))
+	}
+
+	end := start.Add(24 * time.Hour)
+	if endMilli := getIntValueOrDefault(r.PostForm.Get("end"), 0); endMilli > 0 {
+		end = common.FromMilli(int64(endMilli))
+	}
+
+	limit := getIntValueOrDefault(r.PostForm.Get("limit"), 100)
+	if limit <= 0 || limit > 1000 {
+		limit = 1000
+	}
+
+	return start, end, limit
+}
+
+// 计算job从from开始之后的n次执行时间，返回毫秒时间戳
+func nextFireTimes(job *protocol.Job, from time.Time, n int) []int64 {
+
+	jobSchedule, err := schedule.Parse(job)
+	if err != nil {
+		return make([]int64, 0)
+	}
+	return common.MilliTimes(jobSchedule.NextN(from, n))
+}
+
+// 辅助函数，写入一个Server-Sent Event并立即发送，data中的每一行都会作为单独的data字段
+func writeServerSentEvent(rw *bufio.ReadWriter, event string, data string) error {
+
+	_, _ = rw.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		_, _ = rw.WriteString("data: " + line + "\n")
+	}
+	_, _ = rw.WriteString("\n")
+
+	return rw.Flush()
+}
+
 // JobManager错误通用返回
 func jobManagerError(w http.ResponseWriter, op string, err error) {
 	protocol.HttpFail(w, JobManagerErrorNo,
 		fmt.Sprintf("job %s error: %s", op, err), nil)
 
 }
+
+// CalendarManager错误通用返回
+func calendarManagerError(w http.ResponseWriter, op string, err error) {
+	protocol.HttpFail(w, CalendarManagerErrorNo,
+		fmt.Sprintf("calendar %s error: %s", op, err), nil)
+}
+
+// WorkflowManager错误通用返回
+func workflowManagerError(w http.ResponseWriter, op string, err error) {
+	protocol.HttpFail(w, WorkflowManagerErrorNo,
+		fmt.Sprintf("workflow %s error: %s", op, err), nil)
+}
@@ -0,0 +1,157 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/baseconf"
+	"github.com/golazycat/lazycron/common/calendar"
+	"github.com/golazycat/lazycron/common/etcd"
+	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+	"github.com/golazycat/lazycron/common/schedule"
+)
+
+// 日历管理器结构体
+// 日历保存在etcd中，key为日历名称，value为日历序列化的结果，worker会监听日历的变化
+type CalendarManagerBody struct {
+	etcd.Connector
+}
+
+// 保存日历，如果日历已经存在会被覆盖，返回被覆盖的旧日历
+// 保存前会校验日历，校验失败时返回*JobValidationError，日历不会被保存
+func (calendarManager *CalendarManagerBody) SaveCalendar(
+	cal *protocol.Calendar) (*protocol.Calendar, error) {
+
+	CheckCalendarManagerInit()
+
+	if err := ValidateCalendar(cal); err != nil {
+		return nil, err
+	}
+
+	calendarValue, err := json.Marshal(cal)
+	if err != nil {
+		return nil, err
+	}
+
+	putResponse, err := calendarManager.Kv.Put(context.TODO(),
+		common.CalendarPrefix+cal.Name, string(calendarValue), clientv3.WithPrevKV())
+	if err != nil {
+		return nil, err
+	}
+
+	if putResponse.PrevKv != nil {
+		return common.GetCalendarFromKv(putResponse.PrevKv), nil
+	}
+	return nil, nil
+}
+
+// 删除日历，返回被删除的日历，日历不存在时返回nil
+// 引用了被删除日历的job会把这个日历当作不包含任何时间的日历
+func (calendarManager *CalendarManagerBody) DeleteCalendar(name string) (*protocol.Calendar, error) {
+
+	CheckCalendarManagerInit()
+
+	delResponse, err := calendarManager.Kv.Delete(context.TODO(),
+		common.CalendarPrefix+name, clientv3.WithPrevKV())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(delResponse.PrevKvs) != 0 {
+		return common.GetCalendarFromKv(delResponse.PrevKvs[0]), nil
+	}
+	return nil, nil
+}
+
+// 列出所有日历
+func (calendarManager *CalendarManagerBody) ListCalendars() ([]*protocol.Calendar, error) {
+
+	CheckCalendarManagerInit()
+
+	getResponse, err := calendarManager.Kv.Get(context.TODO(),
+		common.CalendarPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	calendars := make([]*protocol.Calendar, 0, len(getResponse.Kvs))
+	for _, kv := range getResponse.Kvs {
+		if cal := common.GetCalendarFromKv(kv); cal != nil {
+			calendars = append(calendars, cal)
+		}
+	}
+	return calendars, nil
+}
+
+// 校验日历的各个字段，校验失败时返回*JobValidationError，其中包含每个字段的错误信息
+// 日历名称会作为etcd key的一部分，因此不能为空，也不能包含'/'
+func ValidateCalendar(cal *protocol.Calendar) error {
+
+	validation := &JobValidationError{}
+
+	if cal.Name == "" {
+		validation.add("name", "name is required")
+	} else if strings.Contains(cal.Name, "/") {
+		validation.add("name", "name can not contain '/'")
+	}
+
+	// 逐个检查日期和窗口，这样可以指出具体是哪一项有错误
+	location, err := schedule.LoadLocation(cal.Timezone)
+	if err != nil {
+		validation.add("timezone", "unknown time zone '%s'", cal.Timezone)
+	} else {
+		for i, date := range cal.Dates {
+			if err := calendar.CheckDate(date, location); err != nil {
+				validation.add(fmt.Sprintf("dates[%d]", i), "%s", err)
+			}
+		}
+		for i, window := range cal.Windows {
+			if err := calendar.CheckWindow(window, location); err != nil {
+				validation.add(fmt.Sprintf("windows[%d]", i), "%s", err)
+			}
+		}
+	}
+
+	if len(validation.Errors) != 0 {
+		return validation
+	}
+	return nil
+}
+
+// CalendarManager 初始化器
+type CalendarManagerInitializer struct {
+	Conf baseconf.EtcdConf
+}
+
+var (
+	CalendarManager CalendarManagerBody
+	isCMInit        = false
+)
+
+// CalendarManager 初始化
+func (c CalendarManagerInitializer) Init() error {
+
+	conn, err := etcd.CreateConnect(&c.Conf)
+	if err != nil {
+		return err
+	}
+
+	CalendarManager.Connector = *conn
+
+	isCMInit = true
+
+	return nil
+}
+
+func CheckCalendarManagerInit() {
+	if !isCMInit {
+		logs.Error.Printf("calendar manager not init!")
+		os.Exit(1)
+	}
+}
@@ -7,12 +7,13 @@ type MasterConf struct {
 	baseconf.EtcdConf
 	baseconf.RunConf
 	baseconf.MongoConf
-	HttpAddress      string `json:"http.addr"`
-	HttpPort         int    `json:"http.port"`
-	HttpReadTimeout  int    `json:"http.read_timeout"`
-	HttpWriteTimeout int    `js￿on:"http.write_timeout"`
-	StaticWebRoot    string `json:"http.static_path"`
-	LogErrorFile     string `json:"log.error_path"`
+	HttpAddress         string `json:"http.addr"`
+	HttpPort            int    `json:"http.port"`
+	HttpReadTimeout     int    `json:"http.read_timeout"`
+	HttpWriteTimeout    int    `js￿on:"http.write_timeout"`
+	StaticWebRoot       string `json:"http.static_path"`
+	LogErrorFile        string `json:"log.error_path"`
+	WorkflowNodeTimeout int    `json:"workflow.node_timeout"`
 }
 
 // Master默认配置
@@ -28,6 +29,7 @@ func (c *MasterConf) SetDefault() {
 	c.HttpWriteTimeout = 5
 	c.StaticWebRoot = "./static"
 	c.LogErrorFile = ""
+	c.WorkflowNodeTimeout = 3600
 
 }
 
@@ -3,20 +3,36 @@ package master
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golazycat/lazycron/master/conf"
 
 	"github.com/golazycat/lazycron/common/etcd"
 
 	"github.com/golazycat/lazycron/common/protocol"
+	"github.com/golazycat/lazycron/common/schedule"
 
 	"github.com/golazycat/lazycron/common"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/golazycat/lazycron/common/logs"
 )
 
+var (
+	JobNotRunningError = errors.New("job is not running")
+	JobNotExistError   = errors.New("job does not exist")
+	JobConflictError   = errors.New("job is modified concurrently")
+)
+
+// 更新job时，因为并发修改而失败的最大重试次数
+const updateJobMaxTries = 3
+
 // 任务管理器结构
 // 保存etcd-cli的对象，以操作etcd来管理job
 type JobManagerBody struct {
@@ -27,29 +43,75 @@ type JobManagerBody struct {
 // etcd中Job的Key将会是job.Name，Value是job序列化的结果
 // 如果这个KV之前已经存在了(发生了替换行为)，则该函数会将旧的job反序列化后返回
 // 注意如果旧的job反序列化失败，函数不会产生异常
+// 保存前会校验job，校验失败时返回*JobValidationError，job不会被保存
+// 保存的job中的暂停状态会被忽略，更新时保留旧job的暂停状态
+// 一次性job设置了delay时，执行时间为从现在开始delay秒之后
 func (jobManager *JobManagerBody) SaveJob(job *protocol.Job) (*protocol.Job, error) {
 
 	CheckJobManagerInit()
 
-	jobKey := common.JobKeyPrefix + job.Name
-	jobValue, err := json.Marshal(job)
-	if err != nil {
-		return nil, err
+	if job.ScheduleType == protocol.ScheduleOnce && job.Delay > 0 {
+		job.RunAt = common.ToMilli(time.Now().Add(common.IntSecond(job.Delay)))
+		job.Delay = 0
 	}
 
-	// 保存到etcd
-	putResponse, err := JobManager.Kv.Put(context.TODO(), jobKey,
-		string(jobValue), clientv3.WithPrevKV())
-	if err != nil {
+	// 执行次数和是否过期是查询时计算的，不需要保存
+	job.Runs = 0
+	job.Expired = false
+
+	if err := ValidateJob(job); err != nil {
 		return nil, err
 	}
 
-	// 如果是更新操作，需要把旧的值返回出去
-	if putResponse.PrevKv != nil {
-		return common.GetJobFromKv(putResponse.PrevKv), nil
+	jobKey := common.JobKeyPrefix + job.Name
+
+	for i := 0; i < updateJobMaxTries; i++ {
+
+		getResponse, err := jobManager.Kv.Get(context.TODO(), jobKey)
+		if err != nil {
+			return nil, err
+		}
+
+		// 暂停状态只能由PauseJob和ResumeJob修改，保存时保留旧job的暂停状态
+		// 写回时检查job在读取之后是否被修改过，防止覆盖同时进行的暂停或者恢复
+		var oldJob *protocol.Job
+		notModified := clientv3.Compare(clientv3.CreateRevision(jobKey), "=", 0)
+		if len(getResponse.Kvs) != 0 {
+			kv := getResponse.Kvs[0]
+			oldJob = common.GetJobFromKv(kv)
+			notModified = clientv3.Compare(clientv3.ModRevision(jobKey), "=", kv.ModRevision)
+		}
+		if oldJob != nil {
+			job.Paused = oldJob.Paused
+			job.PausedAt = oldJob.PausedAt
+			job.PauseReason = oldJob.PauseReason
+		} else {
+			job.Paused = false
+			job.PausedAt = 0
+			job.PauseReason = ""
+		}
+
+		jobValue, err := json.Marshal(job)
+		if err != nil {
+			return nil, err
+		}
+
+		// 保存到etcd
+		txnResponse, err := jobManager.Kv.Txn(context.TODO()).
+			If(notModified).
+			Then(clientv3.OpPut(jobKey, string(jobValue))).
+			Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		// 如果是更新操作，需要把旧的值返回出去
+		if txnResponse.Succeeded {
+			return oldJob, nil
+		}
 	}
 
-	return nil, nil
+	return nil, JobConflictError
 }
 
 // 这个函数会将指定name的Job从etcd中删除
@@ -65,6 +127,9 @@ func (jobManager *JobManagerBody) DeleteJob(name string) (*protocol.Job, error)
 	if err != nil {
 		return nil, err
 	}
+	_, _ = jobManager.Kv.Delete(context.TODO(), common.JobFiredPrefix+name)
+	_, _ = jobManager.Kv.Delete(context.TODO(), common.JobFinishPrefix+name)
+	_, _ = jobManager.Kv.Delete(context.TODO(), common.JobRunCountPrefix+name)
 	if len(delResponse.PrevKvs) != 0 {
 		// 删除操作针对单一job进行
 		return common.GetJobFromKv(delResponse.PrevKvs[0]), nil
@@ -72,7 +137,111 @@ func (jobManager *JobManagerBody) DeleteJob(name string) (*protocol.Job, error)
 	return nil, nil
 }
 
+// 暂停任务，暂停的任务仍然保存在etcd中，但是worker不会再调度执行它，直到任务被恢复
+// reason表示暂停的原因，返回暂停后的job
+func (jobManager *JobManagerBody) PauseJob(name string, reason string) (*protocol.Job, error) {
+
+	return jobManager.updateJob(name, func(job *protocol.Job) {
+		job.Paused = true
+		job.PausedAt = time.Now().UnixNano() / 1000 / 1000
+		job.PauseReason = reason
+	})
+}
+
+// 恢复被暂停的任务，返回恢复后的job
+// 恢复时会把job上一次执行的时间记录为当前时间，这样暂停期间的计划不会被当作错过的执行补执行
+// 上一次执行的时间和job在同一个事务中写入，不会和同时进行的保存或者暂停交错
+func (jobManager *JobManagerBody) ResumeJob(name string) (*protocol.Job, error) {
+
+	firedValue := strconv.FormatInt(common.ToMilli(time.Now()), 10)
+
+	return jobManager.updateJob(name, func(job *protocol.Job) {
+		job.Paused = false
+		job.PausedAt = 0
+		job.PauseReason = ""
+	}, clientv3.OpPut(common.JobFiredPrefix+name, firedValue))
+}
+
+// 读取etcd中的job，调用update修改后写回，ops会和写回job在同一个事务中执行
+// 写回时会检查job在读取之后是否被修改过，如果被修改过会重新读取再修改，多次失败后返回JobConflictError
+// job不存在时返回JobNotExistError
+func (jobManager *JobManagerBody) updateJob(name string,
+	update func(job *protocol.Job), ops ...clientv3.Op) (*protocol.Job, error) {
+
+	CheckJobManagerInit()
+
+	jobKey := common.JobKeyPrefix + name
+
+	for i := 0; i < updateJobMaxTries; i++ {
+
+		getResponse, err := jobManager.Kv.Get(context.TODO(), jobKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(getResponse.Kvs) == 0 {
+			return nil, JobNotExistError
+		}
+
+		kv := getResponse.Kvs[0]
+		job := common.GetJobFromKv(kv)
+		if job == nil {
+			return nil, JobNotExistError
+		}
+
+		update(job)
+		jobValue, err := json.Marshal(job)
+		if err != nil {
+			return nil, err
+		}
+
+		txnResponse, err := jobManager.Kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", kv.ModRevision)).
+			Then(append([]clientv3.Op{clientv3.OpPut(jobKey, string(jobValue))}, ops...)...).
+			Commit()
+		if err != nil {
+			return nil, err
+		}
+		if txnResponse.Succeeded {
+			return job, nil
+		}
+	}
+
+	return nil, JobConflictError
+}
+
+// 获取指定name的任务，任务不存在时返回JobNotExistError
+// 返回的job中带有已经调度执行的次数和是否过期
+func (jobManager *JobManagerBody) GetJob(name string) (*protocol.Job, error) {
+
+	CheckJobManagerInit()
+
+	getResponse, err := jobManager.Kv.Get(context.TODO(), common.JobKeyPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResponse.Kvs) == 0 {
+		return nil, JobNotExistError
+	}
+
+	job := common.GetJobFromKv(getResponse.Kvs[0])
+	if job == nil {
+		return nil, JobNotExistError
+	}
+
+	countResponse, err := jobManager.Kv.Get(context.TODO(), common.JobRunCountPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if len(countResponse.Kvs) != 0 {
+		job.Runs = countResponse.Kvs[0].Version
+	}
+	job.Expired = isJobExpired(job, time.Now())
+
+	return job, nil
+}
+
 // 列出所有任务，从etcd中获取job目录下所有的任务
+// 返回的job中带有已经调度执行的次数和是否过期
 func (jobManager *JobManagerBody) ListJobs() ([]*protocol.Job, error) {
 
 	CheckJobManagerInit()
@@ -84,9 +253,22 @@ func (jobManager *JobManagerBody) ListJobs() ([]*protocol.Job, error) {
 		return nil, err
 	}
 
+	countResponse, err := jobManager.Kv.Get(context.TODO(),
+		common.JobRunCountPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	runCounts := make(map[string]int64, len(countResponse.Kvs))
+	for _, kv := range countResponse.Kvs {
+		runCounts[strings.TrimPrefix(string(kv.Key), common.JobRunCountPrefix)] = kv.Version
+	}
+
+	now := time.Now()
 	jobs := make([]*protocol.Job, 0)
 	for _, kv := range listResponse.Kvs {
 		if job := common.GetJobFromKv(kv); job != nil {
+			job.Runs = runCounts[job.Name]
+			job.Expired = isJobExpired(job, now)
 			jobs = append(jobs, job)
 		}
 	}
@@ -94,30 +276,227 @@ func (jobManager *JobManagerBody) ListJobs() ([]*protocol.Job, error) {
 	return jobs, nil
 }
 
-// 发出杀死任务命令给workers
+// 判断job是否已经过期：超过了结束调度的时间，或者执行次数达到了MaxRuns
+// 过期的job不会再被调度执行，但是仍然保存在etcd中，可以手动执行
+func isJobExpired(job *protocol.Job, now time.Time) bool {
+
+	if job.EndAt > 0 && common.ToMilli(now) > job.EndAt {
+		return true
+	}
+	return job.MaxRuns > 0 && job.Runs >= int64(job.MaxRuns)
+}
+
+// 计算所有任务在(start, end]之间的执行日历，每个任务最多计算limit个执行时间
+// 日历按照执行时刻排序，同一时刻执行的任务会被合并到一起，便于发现重叠执行的任务
+// 被暂停的任务和调度表达式无效的任务不会出现在日历中
+func (jobManager *JobManagerBody) Calendar(start time.Time,
+	end time.Time, limit int) ([]*protocol.ScheduleSlot, error) {
+
+	jobs, err := jobManager.ListJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	slotTable := make(map[int64]*protocol.ScheduleSlot)
+	for _, job := range jobs {
+		if job.Paused {
+			continue
+		}
+
+		jobSchedule, err := schedule.Parse(job)
+		if err != nil {
+			continue
+		}
+
+		for _, fireTime := range jobSchedule.Between(start, end, limit) {
+			milli := common.ToMilli(fireTime)
+			slot, exists := slotTable[milli]
+			if !exists {
+				slot = &protocol.ScheduleSlot{Time: milli}
+				slotTable[milli] = slot
+			}
+			slot.Jobs = append(slot.Jobs, job.Name)
+		}
+	}
+
+	slots := make([]*protocol.ScheduleSlot, 0, len(slotTable))
+	for _, slot := range slotTable {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].Time < slots[j].Time
+	})
+
+	return slots, nil
+}
+
+// 发出杀死任务命令给workers，并等待执行任务的worker上报kill的结果
 // 这个操作会在etcd的KillJobPrefix目录下新加需要kill的jobName
 // 这个kv只会存在1秒的时间，1秒后会自动到期被删除，worker只需要监听到这个变化即可
-// 其它worker收到这个信号之后会去执行kill，随后master就不管了
-func (jobManager JobManagerBody) KillJob(name string) error {
+// worker结束任务的整个进程组之后，会把结果写入JobKillReportPrefix/jobName/runId
+// 正在执行的实例数由JobRunningPrefix下的key得到，收到所有实例的报告或者等待超过wait时返回，wait为0时不等待
+func (jobManager JobManagerBody) KillJob(name string, wait time.Duration) (*protocol.JobKillResult, error) {
 
 	CheckJobManagerInit()
 
+	running, err := jobManager.countRunning(name)
+	if err != nil {
+		return nil, err
+	}
+
 	killKey := common.JobKillPrefix + name
 
 	leaseGrantResponse, err :=
 		jobManager.Lease.Grant(context.TODO(), 1)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	leaseId := leaseGrantResponse.ID
 
-	// 这里不关心kill put操作的返回结果，执行成功即可
-	_, err = jobManager.Kv.Put(context.TODO(), killKey,
+	putResponse, err := jobManager.Kv.Put(context.TODO(), killKey,
 		"", clientv3.WithLease(leaseId))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &protocol.JobKillResult{Running: running, Reports: []*protocol.JobKillReport{}}
+	if running == 0 || wait <= 0 {
+		return result, nil
+	}
+
+	// 从kill之后的revision开始监听，不会漏掉在监听开始之前写入的报告
+	ctx, cancelFunc := context.WithTimeout(context.TODO(), wait)
+	defer cancelFunc()
+	watcher := clientv3.NewWatcher(jobManager.Client)
+	defer watcher.Close()
+	watchChan := watcher.Watch(ctx, common.JobKillReportPrefix+name+"/",
+		clientv3.WithRev(putResponse.Header.Revision+1), clientv3.WithPrefix())
+
+	for watchResponse := range watchChan {
+		for _, event := range watchResponse.Events {
+			if event.Type != mvccpb.PUT {
+				continue
+			}
+
+			var report protocol.JobKillReport
+			if err := json.Unmarshal(event.Kv.Value, &report); err != nil {
+				continue
+			}
+			result.Reports = append(result.Reports, &report)
+			if len(result.Reports) >= running {
+				return result, nil
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// 得到job正在执行的实例数，每一次执行无论并发策略如何，都会在执行期间持有JobRunningPrefix/jobName/runId
+func (jobManager JobManagerBody) countRunning(name string) (int, error) {
+
+	getResponse, err := jobManager.Kv.Get(context.TODO(), common.JobRunningPrefix+name+"/",
+		clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return int(getResponse.Count), nil
+}
+
+// 发出手动执行任务命令给workers
+// 和KillJob一样，这个操作会在etcd的JobRunPrefix目录下新加需要执行的jobName，value为触发信息
+// 这个kv只会存在1秒的时间，worker监听到之后会通过正常的抢锁、执行、记录日志流程执行一次job
+// triggeredBy表示触发者，会被记录在job log中
+func (jobManager *JobManagerBody) RunJob(name string, triggeredBy string) error {
+
+	CheckJobManagerInit()
+
+	getResponse, err := jobManager.Kv.Get(context.TODO(), common.JobKeyPrefix+name)
 	if err != nil {
 		return err
 	}
-	return nil
+	if len(getResponse.Kvs) == 0 {
+		return JobNotExistError
+	}
+
+	return jobManager.TriggerJob(name, &protocol.JobTrigger{
+		TriggeredBy: triggeredBy,
+		TriggerTime: time.Now().UnixNano() / 1000 / 1000,
+	})
+}
+
+// 把触发信息写入etcd的JobRunPrefix目录，让worker执行一次job，不检查job是否存在
+func (jobManager *JobManagerBody) TriggerJob(name string, trigger *protocol.JobTrigger) error {
+
+	CheckJobManagerInit()
+
+	triggerValue, err := json.Marshal(trigger)
+	if err != nil {
+		return err
+	}
+
+	leaseGrantResponse, err :=
+		jobManager.Lease.Grant(context.TODO(), 1)
+	if err != nil {
+		return err
+	}
+
+	_, err = jobManager.Kv.Put(context.TODO(), common.JobRunPrefix+name,
+		string(triggerValue), clientv3.WithLease(leaseGrantResponse.ID))
+	return err
+}
+
+// 跟踪job当前运行的输出
+// 如果这个job有多个正在进行的运行，会跟踪最近开始的那一次。job没有在运行时返回JobNotRunningError
+// 返回的channel会按顺序收到这次运行从开始到现在的所有输出，运行结束或者ctx被取消时channel会被关闭
+func (jobManager *JobManagerBody) WatchJobOutput(ctx context.Context,
+	name string) (<-chan *protocol.JobOutputChunk, error) {
+
+	CheckJobManagerInit()
+
+	outputPrefix := common.JobOutputPrefix + name + "/"
+	getResponse, err := jobManager.Kv.Get(context.TODO(), outputPrefix,
+		append(clientv3.WithLastCreate(), clientv3.WithPrefix())...)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResponse.Kvs) == 0 {
+		return nil, JobNotRunningError
+	}
+
+	// 从key的创建revision开始监听，可以拿到这次运行的全部输出
+	kv := getResponse.Kvs[0]
+	watcher := clientv3.NewWatcher(jobManager.Client)
+	watchChan := watcher.Watch(ctx, string(kv.Key), clientv3.WithRev(kv.CreateRevision))
+
+	chunkChan := make(chan *protocol.JobOutputChunk)
+	go func() {
+		defer close(chunkChan)
+		defer watcher.Close()
+		for watchResponse := range watchChan {
+			for _, event := range watchResponse.Events {
+				if event.Type == mvccpb.DELETE {
+					return
+				}
+
+				var chunk protocol.JobOutputChunk
+				if err := json.Unmarshal(event.Kv.Value, &chunk); err != nil {
+					continue
+				}
+
+				select {
+				case chunkChan <- &chunk:
+				case <-ctx.Done():
+					return
+				}
+				if chunk.Eof {
+					return
+				}
+			}
+		}
+	}()
+
+	return chunkChan, nil
 }
 
 var (
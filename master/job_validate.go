@@ -0,0 +1,227 @@
+package master
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/golazycat/lazycron/common/protocol"
+	"github.com/golazycat/lazycron/common/schedule"
+)
+
+// worker注入给job的标准环境变量的前缀，job不能设置这个前缀的环境变量
+const reservedEnvPrefix = "LAZYCRON_"
+
+// 重试策略最大尝试次数的上限
+const maxRetryAttempts = 100
+
+// job校验错误，保存了所有校验失败的字段
+type JobValidationError struct {
+	Errors []*protocol.FieldError
+}
+
+func (e *JobValidationError) Error() string {
+
+	messages := make([]string, 0, len(e.Errors))
+	for _, fieldError := range e.Errors {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+	return "invalid job: " + strings.Join(messages, "; ")
+}
+
+// 添加一个字段错误
+func (e *JobValidationError) add(field string, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, &protocol.FieldError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// 校验job的各个字段，校验失败时返回*JobValidationError，其中包含每个字段的错误信息
+// job名称会作为etcd key的一部分，因此不能为空，也不能包含'/'
+func ValidateJob(job *protocol.Job) error {
+
+	validation := &JobValidationError{}
+
+	if job.Name == "" {
+		validation.add("name", "name is required")
+	} else if strings.Contains(job.Name, "/") {
+		validation.add("name", "name can not contain '/'")
+	}
+
+	switch job.Type {
+	case "", protocol.JobTypeShell:
+		if strings.TrimSpace(job.Command) == "" {
+			validation.add("command", "command is required")
+		}
+		if job.Shell != "" && !filepath.IsAbs(job.Shell) {
+			validation.add("shell", "shell must be an absolute path")
+		}
+	case protocol.JobTypeExec:
+		if len(job.Args) == 0 || job.Args[0] == "" {
+			validation.add("args", "args is required")
+		}
+	case protocol.JobTypeHttp:
+		validateHttpRequest(job.Http, validation)
+	default:
+		validation.add("type", "unknown job type '%s'", job.Type)
+	}
+
+	if _, err := schedule.LoadLocation(job.Timezone); err != nil {
+		validation.add("timezone", "unknown time zone '%s'", job.Timezone)
+	} else {
+		switch job.ScheduleType {
+		case "", protocol.ScheduleCron:
+			if _, err := schedule.Parse(job); err != nil {
+				validation.add("cron_expr", "invalid cron expression '%s': %s", job.CronExpr, err)
+			}
+		case protocol.ScheduleOnce:
+			if job.RunAt <= 0 {
+				validation.add("run_at", "run_at or delay is required for one-shot job")
+			}
+		case protocol.ScheduleEvery, protocol.ScheduleDelayAfterFinish:
+			if job.Interval <= 0 {
+				validation.add("interval", "interval must be positive")
+			}
+		default:
+			validation.add("schedule_type", "unknown schedule type '%s'", job.ScheduleType)
+		}
+	}
+	if job.Delay < 0 {
+		validation.add("delay", "delay can not be negative")
+	}
+	if job.CompletedTTL < 0 {
+		validation.add("completed_ttl", "completed_ttl can not be negative")
+	}
+	if job.StartAt < 0 {
+		validation.add("start_at", "start_at can not be negative")
+	}
+	if job.EndAt < 0 {
+		validation.add("end_at", "end_at can not be negative")
+	} else if job.EndAt > 0 && job.EndAt < job.StartAt {
+		validation.add("end_at", "end_at can not be earlier than start_at")
+	}
+	if job.MaxRuns < 0 {
+		validation.add("max_runs", "max_runs can not be negative")
+	}
+
+	for key := range job.Env {
+		switch {
+		case key == "" || strings.ContainsAny(key, "=\x00"):
+			validation.add("env", "invalid environment variable name '%s'", key)
+		case strings.HasPrefix(key, reservedEnvPrefix):
+			validation.add("env", "environment variable prefix %s is reserved: '%s'",
+				reservedEnvPrefix, key)
+		}
+	}
+	if job.Workdir != "" && !filepath.IsAbs(job.Workdir) {
+		validation.add("workdir", "workdir must be an absolute path")
+	}
+	if job.RunAs != nil && strings.TrimSpace(job.RunAs.User) == "" {
+		validation.add("run_as", "run_as user is required")
+	}
+	if limits := job.Rlimits; limits != nil &&
+		(limits.Cpu < 0 || limits.Nofile < 0 || limits.As < 0 || limits.Nproc < 0) {
+		validation.add("rlimits", "rlimits can not be negative")
+	}
+	if limits := job.Cgroup; limits != nil &&
+		(limits.MemoryMax < 0 || limits.CpuMax < 0 || limits.PidsMax < 0) {
+		validation.add("cgroup", "cgroup limits can not be negative")
+	}
+
+	if job.Jitter < 0 {
+		validation.add("jitter", "jitter can not be negative")
+	}
+	if job.Timeout < 0 {
+		validation.add("timeout", "timeout can not be negative")
+	}
+	if job.LockTTL < 0 {
+		validation.add("lock_ttl", "lock_ttl can not be negative")
+	}
+	if job.KillGrace < 0 {
+		validation.add("kill_grace", "kill_grace can not be negative")
+	}
+	if job.OutputLimit < 0 {
+		validation.add("output_limit", "output_limit can not be negative")
+	}
+
+	switch job.ConcurrencyPolicy {
+	case "", protocol.ConcurrencyForbid, protocol.ConcurrencyReplace:
+		if job.MaxConcurrent > 1 {
+			validation.add("max_concurrent",
+				"max_concurrent must be at most 1 when concurrency_policy is forbid or replace")
+		}
+	case protocol.ConcurrencyAllow, protocol.ConcurrencyQueue:
+	default:
+		validation.add("concurrency_policy", "unknown concurrency policy '%s'", job.ConcurrencyPolicy)
+	}
+	if job.MaxConcurrent < 0 {
+		validation.add("max_concurrent", "max_concurrent can not be negative")
+	}
+
+	if retry := job.Retry; retry != nil {
+		if retry.MaxAttempts < 1 {
+			validation.add("retry.max_attempts", "max_attempts must be at least 1")
+		} else if retry.MaxAttempts > maxRetryAttempts {
+			validation.add("retry.max_attempts", "max_attempts can not exceed %d", maxRetryAttempts)
+		}
+		if retry.Backoff != "" && retry.Backoff != protocol.RetryBackoffFixed &&
+			retry.Backoff != protocol.RetryBackoffExponential {
+			validation.add("retry.backoff", "unknown backoff '%s'", retry.Backoff)
+		}
+		if retry.Interval < 0 {
+			validation.add("retry.interval", "interval can not be negative")
+		}
+		if retry.MaxInterval < 0 {
+			validation.add("retry.max_interval", "max_interval can not be negative")
+		}
+	}
+
+	if misfire := job.Misfire; misfire != nil {
+		switch misfire.Policy {
+		case "", protocol.MisfireSkip, protocol.MisfireRunOnce, protocol.MisfireRunAll:
+		default:
+			validation.add("misfire.policy", "unknown misfire policy '%s'", misfire.Policy)
+		}
+		if misfire.Threshold < 0 {
+			validation.add("misfire.threshold", "threshold can not be negative")
+		}
+		if misfire.Limit < 0 {
+			validation.add("misfire.limit", "limit can not be negative")
+		}
+	}
+
+	if len(validation.Errors) != 0 {
+		return validation
+	}
+	return nil
+}
+
+// 校验http类型job的请求
+func validateHttpRequest(spec *protocol.HttpRequest, validation *JobValidationError) {
+
+	if spec == nil {
+		validation.add("http", "http is required")
+		return
+	}
+
+	if requestUrl, err := url.Parse(spec.Url); err != nil || spec.Url == "" ||
+		(requestUrl.Scheme != "http" && requestUrl.Scheme != "https") {
+		validation.add("http.url", "invalid url '%s'", spec.Url)
+	}
+
+	switch strings.ToUpper(spec.Method) {
+	case "", http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		validation.add("http.method", "unknown method '%s'", spec.Method)
+	}
+
+	for i, status := range spec.ExpectStatus {
+		if status < 100 || status > 599 {
+			validation.add(fmt.Sprintf("http.expect_status[%d]", i), "invalid status %d", status)
+		}
+	}
+}
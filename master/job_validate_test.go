@@ -0,0 +1,53 @@
+package master
+
+import (
+	"testing"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestValidateJob(t *testing.T) {
+
+	job := &protocol.Job{Name: "echo", Command: "echo hello", CronExpr: "*/5 * * * * * *"}
+	if err := ValidateJob(job); err != nil {
+		t.Errorf("Error Validate: %v", err)
+	}
+
+	job = &protocol.Job{Name: "ping", Type: protocol.JobTypeHttp, CronExpr: "* * * * *",
+		Http: &protocol.HttpRequest{Url: "ftp://example.com", ExpectStatus: []int{200, 42}}}
+	if validation, ok := ValidateJob(job).(*JobValidationError); !ok || len(validation.Errors) != 2 {
+		t.Errorf("Error Validate: %v", validation)
+	}
+
+	job = &protocol.Job{Name: "once", Command: "echo hello", ScheduleType: protocol.ScheduleOnce}
+	if err := ValidateJob(job); err == nil {
+		t.Errorf("Error Validate: one-shot job without run_at accepted")
+	}
+
+	job = &protocol.Job{Name: "a/b", CronExpr: "* * *",
+		Retry: &protocol.RetryPolicy{Backoff: "linear"}, ConcurrencyPolicy: "parallel",
+		Misfire: &protocol.MisfirePolicy{Policy: "runall", Threshold: -1, Limit: -1}}
+	err := ValidateJob(job)
+	validation, ok := err.(*JobValidationError)
+	if !ok {
+		t.Fatalf("Error Validate: %v", err)
+	}
+
+	fields := make(map[string]bool)
+	for _, fieldError := range validation.Errors {
+		fields[fieldError.Field] = true
+	}
+	for _, field := range []string{"name", "command", "cron_expr",
+		"retry.max_attempts", "retry.backoff", "concurrency_policy",
+		"misfire.policy", "misfire.threshold", "misfire.limit"} {
+		if !fields[field] {
+			t.Errorf("Error Validate: field %s not reported", field)
+		}
+	}
+
+	job = &protocol.Job{Name: "retry", Command: "false", CronExpr: "* * * * *",
+		Retry: &protocol.RetryPolicy{MaxAttempts: maxRetryAttempts + 1}}
+	if err := ValidateJob(job); err == nil {
+		t.Errorf("Error Validate: max_attempts %d accepted", job.Retry.MaxAttempts)
+	}
+}
@@ -31,6 +31,9 @@ func Start(simple bool) {
 	baseinit.Init(WorkerManagerInitializer{
 		Conf: masterConf.EtcdConf}, "worker manager")
 
+	baseinit.Init(CalendarManagerInitializer{
+		Conf: masterConf.EtcdConf}, "calendar manager")
+
 	// 初始化环境
 	baseinit.Init(baseinit.RunInitializer{
 		RunConf: &masterConf.RunConf}, "runtime")
@@ -39,6 +42,15 @@ func Start(simple bool) {
 	baseinit.Init(JobManagerInitializer{
 		Conf: masterConf}, "job manager")
 
+	// 初始化WorkflowManager，并开始协调工作流
+	baseinit.Init(WorkflowManagerInitializer{
+		Conf:        masterConf.EtcdConf,
+		NodeTimeout: masterConf.WorkflowNodeTimeout}, "workflow manager")
+	if err := WorkflowManager.BeginCoordinate(); err != nil {
+		logs.Error.Printf("workflow coordinate error: %s", err)
+		os.Exit(1)
+	}
+
 	// 初始化HttpApiServer
 	baseinit.Init(ApiServerInitializer{
 		Conf: masterConf}, "http api")
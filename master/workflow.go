@@ -0,0 +1,288 @@
+package master
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/protocol"
+	"github.com/golazycat/lazycron/common/schedule"
+	"github.com/google/uuid"
+)
+
+// 校验工作流，校验失败时返回*JobValidationError，其中包含每个字段的错误信息
+// 工作流中的job不能重复，边必须连接工作流中的job，并且整个工作流不能有环；设置了cron_expr时它必须可以解析
+func ValidateWorkflow(workflow *protocol.Workflow) error {
+
+	validation := &JobValidationError{}
+
+	if workflow.Name == "" {
+		validation.add("name", "name is required")
+	} else if strings.Contains(workflow.Name, "/") {
+		validation.add("name", "name can not contain '/'")
+	}
+
+	if len(workflow.Jobs) == 0 {
+		validation.add("jobs", "jobs is required")
+	}
+	jobs := make(map[string]bool, len(workflow.Jobs))
+	for i, job := range workflow.Jobs {
+		field := fmt.Sprintf("jobs[%d]", i)
+		switch {
+		case job == "":
+			validation.add(field, "job name is required")
+		case jobs[job]:
+			validation.add(field, "duplicate job '%s'", job)
+		}
+		jobs[job] = true
+	}
+
+	edges := make(map[string]bool, len(workflow.Edges))
+	for i, edge := range workflow.Edges {
+		field := fmt.Sprintf("edges[%d]", i)
+		if edge == nil {
+			validation.add(field, "edge is required")
+			continue
+		}
+		if !jobs[edge.From] {
+			validation.add(field, "unknown job '%s'", edge.From)
+		}
+		if !jobs[edge.To] {
+			validation.add(field, "unknown job '%s'", edge.To)
+		}
+		if edge.From == edge.To {
+			validation.add(field, "edge can not point to itself")
+		}
+		switch edge.Condition {
+		case "", protocol.WorkflowOnSuccess, protocol.WorkflowOnFailure, protocol.WorkflowOnAlways:
+		default:
+			validation.add(field, "unknown condition '%s'", edge.Condition)
+		}
+		key := edge.From + "->" + edge.To
+		if edges[key] {
+			validation.add(field, "duplicate edge %s", key)
+		}
+		edges[key] = true
+	}
+
+	if len(validation.Errors) == 0 && hasCycle(workflow) {
+		validation.add("edges", "workflow contains a cycle")
+	}
+
+	if _, err := schedule.LoadLocation(workflow.Timezone); err != nil {
+		validation.add("timezone", "unknown time zone '%s'", workflow.Timezone)
+	} else if workflow.CronExpr != "" {
+		if _, err := workflowSchedule(workflow); err != nil {
+			validation.add("cron_expr", "invalid cron expression '%s': %s", workflow.CronExpr, err)
+		}
+	}
+
+	if len(validation.Errors) != 0 {
+		return validation
+	}
+	return nil
+}
+
+// 判断工作流是否有环，不断删除没有入边的job，最后还有剩下的job说明有环
+func hasCycle(workflow *protocol.Workflow) bool {
+
+	inDegree := make(map[string]int, len(workflow.Jobs))
+	for _, edge := range workflow.Edges {
+		inDegree[edge.To]++
+	}
+
+	queue := make([]string, 0, len(workflow.Jobs))
+	for _, job := range workflow.Jobs {
+		if inDegree[job] == 0 {
+			queue = append(queue, job)
+		}
+	}
+
+	visited := 0
+	for len(queue) != 0 {
+		job := queue[0]
+		queue = queue[1:]
+		visited++
+
+		for _, edge := range workflow.Edges {
+			if edge.From == job {
+				inDegree[edge.To]--
+				if inDegree[edge.To] == 0 {
+					queue = append(queue, edge.To)
+				}
+			}
+		}
+	}
+
+	return visited != len(workflow.Jobs)
+}
+
+// 解析工作流的cron表达式，和job一样，表达式中的H依据工作流名称展开
+func workflowSchedule(workflow *protocol.Workflow) (*schedule.Schedule, error) {
+	return schedule.Parse(&protocol.Job{Name: workflow.Name,
+		CronExpr: workflow.CronExpr, Timezone: workflow.Timezone})
+}
+
+// 设置了cron_expr的工作流的调度计划，cronExpr和timezone用于发现工作流的修改
+type workflowPlan struct {
+	cronExpr string
+	timezone string
+	schedule *schedule.Schedule
+	next     time.Time
+}
+
+// 依据当前的工作流更新调度计划，返回到达计划时间的工作流名称和计划时间
+// 新的或者被修改的工作流从now之后的计划时间开始调度；错过的多个计划时间只会运行一次
+func dueWorkflows(plans map[string]*workflowPlan, workflows []*protocol.Workflow,
+	now time.Time) map[string]time.Time {
+
+	due := make(map[string]time.Time)
+	scheduled := make(map[string]bool, len(workflows))
+	for _, workflow := range workflows {
+		if workflow.CronExpr == "" {
+			continue
+		}
+		scheduled[workflow.Name] = true
+
+		plan := plans[workflow.Name]
+		if plan == nil || plan.cronExpr != workflow.CronExpr || plan.timezone != workflow.Timezone {
+			planSchedule, err := workflowSchedule(workflow)
+			if err != nil {
+				delete(plans, workflow.Name)
+				continue
+			}
+			plans[workflow.Name] = &workflowPlan{cronExpr: workflow.CronExpr, timezone: workflow.Timezone,
+				schedule: planSchedule, next: planSchedule.Next(now)}
+			continue
+		}
+
+		if !plan.next.IsZero() && !now.Before(plan.next) {
+			due[workflow.Name] = plan.next
+			plan.next = plan.schedule.Next(now)
+		}
+	}
+
+	for name := range plans {
+		if !scheduled[name] {
+			delete(plans, name)
+		}
+	}
+	return due
+}
+
+// 创建工作流的一次运行，所有节点都处于等待状态，需要调用advanceWorkflowRun开始执行
+// 运行中保存了工作流的副本，运行期间修改工作流不会影响这次运行
+func CreateWorkflowRun(workflow *protocol.Workflow, triggeredBy string) *protocol.WorkflowRun {
+
+	run := &protocol.WorkflowRun{
+		ID:          uuid.New().String(),
+		Workflow:    workflow,
+		Status:      protocol.WorkflowStatusRunning,
+		TriggeredBy: triggeredBy,
+		StartTime:   common.ToMilli(time.Now()),
+		Nodes:       make(map[string]*protocol.WorkflowNodeState, len(workflow.Jobs)),
+	}
+	for _, job := range workflow.Jobs {
+		run.Nodes[job] = &protocol.WorkflowNodeState{Status: protocol.WorkflowStatusPending}
+	}
+	return run
+}
+
+// 推进工作流的运行，返回需要开始执行的job，这些节点会被标记为运行中
+// 一个等待中的节点，所有上游都结束后：所有入边的条件都满足时开始执行，否则被跳过
+// 跳过会继续影响下游，因此会反复检查直到没有节点的状态变化
+// 所有节点都结束后，工作流运行结束，有失败的节点时工作流为失败，否则为成功
+func advanceWorkflowRun(run *protocol.WorkflowRun, now time.Time) []string {
+
+	started := make([]string, 0)
+
+	for changed := true; changed; {
+		changed = false
+
+		for _, job := range run.Workflow.Jobs {
+			node := run.Nodes[job]
+			if node.Status != protocol.WorkflowStatusPending {
+				continue
+			}
+
+			ready, satisfied := checkUpstream(run, job)
+			if !ready {
+				continue
+			}
+
+			changed = true
+			if satisfied {
+				node.Status = protocol.WorkflowStatusRunning
+				node.StartTime = common.ToMilli(now)
+				started = append(started, job)
+			} else {
+				node.Status = protocol.WorkflowStatusSkipped
+				node.EndTime = common.ToMilli(now)
+			}
+		}
+	}
+
+	finished, failed := true, false
+	for _, node := range run.Nodes {
+		switch node.Status {
+		case protocol.WorkflowStatusPending, protocol.WorkflowStatusRunning:
+			finished = false
+		case protocol.WorkflowStatusFailed:
+			failed = true
+		}
+	}
+
+	if finished {
+		run.Status = protocol.WorkflowStatusSuccess
+		if failed {
+			run.Status = protocol.WorkflowStatusFailed
+		}
+		run.EndTime = common.ToMilli(now)
+	}
+
+	return started
+}
+
+// 设置了超时时间的job，节点的期限在超时时间之外额外等待的秒数，覆盖抢锁、kill的宽限时间和上报结果的时间
+const workflowNodeDeadlineMargin = 60
+
+// 计算运行中节点等待结果的期限，从节点被触发的时间开始计算
+// job设置了超时时间时为超时时间加上jitter和额外的等待时间，否则为defaultTimeout秒；job为nil表示job已经被删除
+func nodeDeadline(node *protocol.WorkflowNodeState, job *protocol.Job, defaultTimeout int) time.Time {
+
+	timeout := defaultTimeout
+	if job != nil && job.Timeout > 0 {
+		timeout = job.Timeout + job.KillGrace + job.Jitter + workflowNodeDeadlineMargin
+	}
+	return common.FromMilli(node.StartTime).Add(common.IntSecond(timeout))
+}
+
+// 检查节点的上游，ready表示所有上游是否都已经结束，satisfied表示所有入边的条件是否都满足
+func checkUpstream(run *protocol.WorkflowRun, job string) (ready bool, satisfied bool) {
+
+	ready, satisfied = true, true
+
+	for _, edge := range run.Workflow.Edges {
+		if edge.To != job {
+			continue
+		}
+
+		upstream := run.Nodes[edge.From].Status
+		switch upstream {
+		case protocol.WorkflowStatusPending, protocol.WorkflowStatusRunning:
+			return false, false
+		}
+
+		switch edge.Condition {
+		case protocol.WorkflowOnFailure:
+			satisfied = satisfied && upstream == protocol.WorkflowStatusFailed
+		case protocol.WorkflowOnAlways:
+			satisfied = satisfied && upstream != protocol.WorkflowStatusSkipped
+		default:
+			satisfied = satisfied && upstream == protocol.WorkflowStatusSuccess
+		}
+	}
+
+	return ready, satisfied
+}
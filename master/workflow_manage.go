@@ -0,0 +1,578 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/baseconf"
+	"github.com/golazycat/lazycron/common/etcd"
+	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+var (
+	WorkflowNotExistError    = errors.New("workflow does not exist")
+	WorkflowRunNotExistError = errors.New("workflow run does not exist")
+	NoWorkerOnlineError      = errors.New("no worker is online")
+	NodeDeadlineError        = errors.New("no result is reported before the deadline")
+	WorkflowFireClaimedError = errors.New("workflow schedule is claimed by another master")
+)
+
+const (
+	// 结束的工作流运行在etcd中保存的秒数
+	workflowRunTTL = 7 * 24 * 3600
+	// 检查运行中的节点是否超过期限的间隔
+	workflowReapInterval = 10 * time.Second
+	// 监听worker上报的结果中断后，重新监听之前等待的时间
+	workflowRewatchInterval = time.Second
+	// 检查工作流是否到达计划时间的间隔
+	workflowScheduleInterval = time.Second
+	// 认领工作流计划时间的记录保存的秒数
+	workflowFireClaimTTL = 60
+	// 按计划时间开始的工作流运行的触发者
+	workflowScheduleTrigger = "schedule"
+)
+
+// 工作流管理器结构体
+// 工作流和工作流的运行都保存在etcd中；同时它也是工作流的协调器，
+// 监听worker上报的job执行结果，更新工作流运行的状态并触发下游的job
+// nodeTimeout: job没有设置超时时间时，节点等待结果的秒数，见nodeDeadline
+// cancelFunc: 停止协调，见EndCoordinate
+type WorkflowManagerBody struct {
+	etcd.Connector
+	nodeTimeout int
+	cancelFunc  context.CancelFunc
+}
+
+// 保存工作流，如果工作流已经存在会被覆盖，返回被覆盖的旧工作流
+// 保存前会校验工作流，并检查工作流中的job都存在，校验失败时返回*JobValidationError
+func (workflowManager *WorkflowManagerBody) SaveWorkflow(
+	workflow *protocol.Workflow) (*protocol.Workflow, error) {
+
+	CheckWorkflowManagerInit()
+
+	if err := ValidateWorkflow(workflow); err != nil {
+		return nil, err
+	}
+
+	validation := &JobValidationError{}
+	for i, job := range workflow.Jobs {
+		if _, err := JobManager.GetJob(job); err == JobNotExistError {
+			validation.add(fmt.Sprintf("jobs[%d]", i), "job '%s' does not exist", job)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(validation.Errors) != 0 {
+		return nil, validation
+	}
+
+	workflowValue, err := json.Marshal(workflow)
+	if err != nil {
+		return nil, err
+	}
+
+	putResponse, err := workflowManager.Kv.Put(context.TODO(),
+		common.WorkflowPrefix+workflow.Name, string(workflowValue), clientv3.WithPrevKV())
+	if err != nil {
+		return nil, err
+	}
+
+	if putResponse.PrevKv != nil {
+		return getWorkflowFromKv(putResponse.PrevKv), nil
+	}
+	return nil, nil
+}
+
+// 删除工作流，返回被删除的工作流，工作流不存在时返回nil
+// 已经开始的工作流运行保存了工作流的副本，不受影响
+func (workflowManager *WorkflowManagerBody) DeleteWorkflow(name string) (*protocol.Workflow, error) {
+
+	CheckWorkflowManagerInit()
+
+	delResponse, err := workflowManager.Kv.Delete(context.TODO(),
+		common.WorkflowPrefix+name, clientv3.WithPrevKV())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(delResponse.PrevKvs) != 0 {
+		return getWorkflowFromKv(delResponse.PrevKvs[0]), nil
+	}
+	return nil, nil
+}
+
+// 列出所有工作流
+func (workflowManager *WorkflowManagerBody) ListWorkflows() ([]*protocol.Workflow, error) {
+
+	CheckWorkflowManagerInit()
+
+	getResponse, err := workflowManager.Kv.Get(context.TODO(),
+		common.WorkflowPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	workflows := make([]*protocol.Workflow, 0, len(getResponse.Kvs))
+	for _, kv := range getResponse.Kvs {
+		if workflow := getWorkflowFromKv(kv); workflow != nil {
+			workflows = append(workflows, workflow)
+		}
+	}
+	return workflows, nil
+}
+
+// 开始工作流的一次运行，会立即触发工作流中没有上游的job，返回这次运行
+func (workflowManager *WorkflowManagerBody) RunWorkflow(name string,
+	triggeredBy string) (*protocol.WorkflowRun, error) {
+
+	CheckWorkflowManagerInit()
+
+	getResponse, err := workflowManager.Kv.Get(context.TODO(), common.WorkflowPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResponse.Kvs) == 0 {
+		return nil, WorkflowNotExistError
+	}
+	workflow := getWorkflowFromKv(getResponse.Kvs[0])
+	if workflow == nil {
+		return nil, WorkflowNotExistError
+	}
+
+	run := CreateWorkflowRun(workflow, triggeredBy)
+	started := advanceWorkflowRun(run, time.Now())
+
+	runValue, err := json.Marshal(run)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := workflowManager.Kv.Put(context.TODO(),
+		common.WorkflowRunPrefix+run.ID, string(runValue)); err != nil {
+		return nil, err
+	}
+
+	workflowManager.triggerNodes(run, started)
+	return run, nil
+}
+
+// 取得工作流的一次运行
+func (workflowManager *WorkflowManagerBody) GetWorkflowRun(runID string) (*protocol.WorkflowRun, error) {
+
+	CheckWorkflowManagerInit()
+
+	getResponse, err := workflowManager.Kv.Get(context.TODO(), common.WorkflowRunPrefix+runID)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResponse.Kvs) == 0 {
+		return nil, WorkflowRunNotExistError
+	}
+
+	run := getWorkflowRunFromKv(getResponse.Kvs[0])
+	if run == nil {
+		return nil, WorkflowRunNotExistError
+	}
+	return run, nil
+}
+
+// 列出工作流的所有运行，按开始时间从新到旧排序
+func (workflowManager *WorkflowManagerBody) ListWorkflowRuns(name string) ([]*protocol.WorkflowRun, error) {
+
+	CheckWorkflowManagerInit()
+
+	getResponse, err := workflowManager.Kv.Get(context.TODO(),
+		common.WorkflowRunPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]*protocol.WorkflowRun, 0)
+	for _, kv := range getResponse.Kvs {
+		if run := getWorkflowRunFromKv(kv); run != nil && run.Workflow.Name == name {
+			runs = append(runs, run)
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartTime > runs[j].StartTime
+	})
+	return runs, nil
+}
+
+// 开始协调工作流，先处理已经上报的所有结果，再持续监听worker上报的结果，见keepWatchResults
+// 同时定期检查运行中的节点，超过期限的节点被当作执行失败，见reapExpiredNodes；
+// 并按cron_expr定时开始工作流运行，见scheduleWorkflows
+func (workflowManager *WorkflowManagerBody) BeginCoordinate() error {
+
+	CheckWorkflowManagerInit()
+
+	revision, err := workflowManager.handlePendingResults()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.TODO())
+	workflowManager.cancelFunc = cancelFunc
+
+	go workflowManager.keepWatchResults(ctx, revision)
+	go workflowManager.scheduleWorkflows(ctx)
+
+	go func() {
+		ticker := time.NewTicker(workflowReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				workflowManager.reapExpiredNodes(now)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// 停止协调工作流，已经开始的运行会在重新开始协调之后继续推进
+func (workflowManager *WorkflowManagerBody) EndCoordinate() {
+	if workflowManager.cancelFunc != nil {
+		workflowManager.cancelFunc()
+	}
+}
+
+// 处理已经上报但还没有处理的所有结果，返回读取时的revision
+func (workflowManager *WorkflowManagerBody) handlePendingResults() (int64, error) {
+
+	getResponse, err := workflowManager.Kv.Get(context.TODO(),
+		common.WorkflowResultPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, kv := range getResponse.Kvs {
+		workflowManager.handleResult(kv)
+	}
+	return getResponse.Header.Revision, nil
+}
+
+// 从revision之后持续监听worker上报的结果，直到ctx被取消
+// 监听中断时(revision被压缩、和etcd的连接断开等)记录错误并重新监听；处理过的结果都已经被删除，
+// 因此重新监听之前先处理所有剩余的结果，再从读取时的revision之后监听，中断期间上报的结果不会丢失
+func (workflowManager *WorkflowManagerBody) keepWatchResults(ctx context.Context, revision int64) {
+
+	for {
+		watcher := clientv3.NewWatcher(workflowManager.Client)
+		watchChan := watcher.Watch(ctx, common.WorkflowResultPrefix,
+			clientv3.WithRev(revision+1), clientv3.WithPrefix())
+
+		for watchResponse := range watchChan {
+			if err := watchResponse.Err(); err != nil {
+				logs.Warn.Printf("watch workflow results error: %s", err)
+				break
+			}
+			for _, event := range watchResponse.Events {
+				if event.Type == mvccpb.PUT {
+					workflowManager.handleResult(event.Kv)
+				}
+			}
+		}
+		_ = watcher.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(workflowRewatchInterval):
+			}
+
+			var err error
+			if revision, err = workflowManager.handlePendingResults(); err == nil {
+				break
+			}
+			logs.Warn.Printf("read workflow results error: %s", err)
+		}
+		logs.Warn.Printf("workflow result watch is interrupted, watch again from revision %d", revision+1)
+	}
+}
+
+// 定期检查设置了cron_expr的工作流，到达计划时间时开始一次运行，直到ctx被取消
+// 计划时间需要先在etcd中认领，多个master同时运行时只有一个会开始运行；master停止期间错过的计划时间不会补上
+func (workflowManager *WorkflowManagerBody) scheduleWorkflows(ctx context.Context) {
+
+	plans := make(map[string]*workflowPlan)
+	ticker := time.NewTicker(workflowScheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			workflows, err := workflowManager.ListWorkflows()
+			if err != nil {
+				logs.Warn.Printf("list workflows error: %s", err)
+				continue
+			}
+
+			for name, planTime := range dueWorkflows(plans, workflows, now) {
+				if err := workflowManager.claimWorkflowFire(name, planTime); err != nil {
+					if err != WorkflowFireClaimedError {
+						logs.Warn.Printf("claim schedule of workflow %s error: %s", name, err)
+					}
+					continue
+				}
+				if _, err := workflowManager.RunWorkflow(name, workflowScheduleTrigger); err != nil {
+					logs.Warn.Printf("run workflow %s on schedule error: %s", name, err)
+				}
+			}
+		}
+	}
+}
+
+// 认领工作流的一个计划时间，已经被其它master认领时返回WorkflowFireClaimedError
+func (workflowManager *WorkflowManagerBody) claimWorkflowFire(name string, planTime time.Time) error {
+
+	leaseResponse, err := workflowManager.Lease.Grant(context.TODO(), workflowFireClaimTTL)
+	if err != nil {
+		return err
+	}
+
+	claimKey := common.WorkflowFiredPrefix + name + "/" + strconv.FormatInt(common.ToMilli(planTime), 10)
+	txnResponse, err := workflowManager.Kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(claimKey), "=", 0)).
+		Then(clientv3.OpPut(claimKey, "", clientv3.WithLease(leaseResponse.ID))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResponse.Succeeded {
+		_, _ = workflowManager.Lease.Revoke(context.TODO(), leaseResponse.ID)
+		return WorkflowFireClaimedError
+	}
+	return nil
+}
+
+// 为超过期限还没有结果的运行中节点上报失败的结果，由协调器把它当作执行失败处理
+// 没有worker收到触发、执行的worker宕机等情况下不会有worker上报结果，期限保证工作流运行能够结束
+// 期限内收到的真正结果会先被处理，之后上报的失败结果会因为节点已经结束而被忽略
+func (workflowManager *WorkflowManagerBody) reapExpiredNodes(now time.Time) {
+
+	getResponse, err := workflowManager.Kv.Get(context.TODO(),
+		common.WorkflowRunPrefix, clientv3.WithPrefix())
+	if err != nil {
+		logs.Warn.Printf("list workflow runs error: %s", err)
+		return
+	}
+
+	for _, kv := range getResponse.Kvs {
+		run := getWorkflowRunFromKv(kv)
+		if run == nil || run.Status != protocol.WorkflowStatusRunning {
+			continue
+		}
+
+		for job, node := range run.Nodes {
+			if node.Status != protocol.WorkflowStatusRunning {
+				continue
+			}
+
+			// job被删除时使用默认的期限
+			jobSpec, _ := JobManager.GetJob(job)
+			if now.Before(nodeDeadline(node, jobSpec, workflowManager.nodeTimeout)) {
+				continue
+			}
+
+			logs.Warn.Printf("job %s of workflow run %s reached deadline", job, run.ID)
+			workflowManager.failNode(run.ID, job, NodeDeadlineError)
+		}
+	}
+}
+
+// 处理一个worker上报的job执行结果
+// 更新节点的状态，推进工作流的运行，并在同一个事务中删除这个结果；保存成功之后再触发下游的job
+// 事务会检查工作流运行在读取之后是否被修改过，被修改过时重新读取再处理
+func (workflowManager *WorkflowManagerBody) handleResult(kv *mvccpb.KeyValue) {
+
+	resultKey := string(kv.Key)
+	runID, job := parseWorkflowResultKey(resultKey)
+
+	var state protocol.WorkflowNodeState
+	if err := json.Unmarshal(kv.Value, &state); err != nil {
+		_, _ = workflowManager.Kv.Delete(context.TODO(), resultKey)
+		return
+	}
+
+	runKey := common.WorkflowRunPrefix + runID
+	for i := 0; i < updateJobMaxTries; i++ {
+
+		getResponse, err := workflowManager.Kv.Get(context.TODO(), runKey)
+		if err != nil {
+			logs.Warn.Printf("get workflow run %s error: %s", runID, err)
+			return
+		}
+
+		var run *protocol.WorkflowRun
+		if len(getResponse.Kvs) != 0 {
+			run = getWorkflowRunFromKv(getResponse.Kvs[0])
+		}
+
+		// 运行不存在或者节点已经结束，只删除结果
+		var node *protocol.WorkflowNodeState
+		if run != nil {
+			node = run.Nodes[job]
+		}
+		if node == nil || node.Status != protocol.WorkflowStatusRunning {
+			_, _ = workflowManager.Kv.Delete(context.TODO(), resultKey)
+			return
+		}
+
+		// 没有真正执行的节点，保留节点被触发的时间
+		if state.StartTime == 0 {
+			state.StartTime = node.StartTime
+		}
+		*node = state
+		started := advanceWorkflowRun(run, time.Now())
+
+		runValue, err := json.Marshal(run)
+		if err != nil {
+			return
+		}
+
+		putOptions := make([]clientv3.OpOption, 0, 1)
+		if run.Status != protocol.WorkflowStatusRunning {
+			leaseResponse, err := workflowManager.Lease.Grant(context.TODO(), workflowRunTTL)
+			if err != nil {
+				logs.Warn.Printf("grant lease for workflow run %s error: %s", runID, err)
+				return
+			}
+			putOptions = append(putOptions, clientv3.WithLease(leaseResponse.ID))
+		}
+
+		txnResponse, err := workflowManager.Kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(runKey), "=", getResponse.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(runKey, string(runValue), putOptions...),
+				clientv3.OpDelete(resultKey)).
+			Commit()
+		if err != nil {
+			logs.Warn.Printf("update workflow run %s error: %s", runID, err)
+			return
+		}
+
+		if txnResponse.Succeeded {
+			workflowManager.triggerNodes(run, started)
+			return
+		}
+	}
+
+	logs.Warn.Printf("update workflow run %s error: %s", runID, JobConflictError)
+}
+
+// 触发工作流运行中开始执行的job
+// 触发失败或者没有在线的worker时，直接为这个节点上报失败的结果，由协调器把它当作执行失败处理
+func (workflowManager *WorkflowManagerBody) triggerNodes(run *protocol.WorkflowRun, jobs []string) {
+
+	for _, job := range jobs {
+
+		// 触发的kv只存在1秒，没有在线的worker时不会有worker收到触发
+		err := NoWorkerOnlineError
+		if workers, listErr := WorkerManager.GetWorkers(); listErr != nil || len(workers) != 0 {
+			err = JobManager.TriggerJob(job, &protocol.JobTrigger{
+				TriggeredBy:   "workflow:" + run.Workflow.Name,
+				TriggerTime:   common.ToMilli(time.Now()),
+				Workflow:      run.Workflow.Name,
+				WorkflowRunID: run.ID,
+			})
+		}
+		if err == nil {
+			continue
+		}
+
+		logs.Warn.Printf("trigger job %s of workflow run %s error: %s", job, run.ID, err)
+		workflowManager.failNode(run.ID, job, err)
+	}
+}
+
+// 为工作流运行的节点上报失败的结果
+func (workflowManager *WorkflowManagerBody) failNode(runID string, job string, err error) {
+
+	state, _ := json.Marshal(&protocol.WorkflowNodeState{
+		Status:  protocol.WorkflowStatusFailed,
+		Err:     err.Error(),
+		EndTime: common.ToMilli(time.Now()),
+	})
+	_, _ = workflowManager.Kv.Put(context.TODO(),
+		common.WorkflowResultPrefix+runID+"/"+job, string(state))
+}
+
+// 从结果的key中取得工作流运行ID和job名称
+func parseWorkflowResultKey(key string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(key, common.WorkflowResultPrefix), "/", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// 从KV中解析工作流，解析失败时返回nil
+func getWorkflowFromKv(kv *mvccpb.KeyValue) *protocol.Workflow {
+
+	var workflow protocol.Workflow
+	if err := json.Unmarshal(kv.Value, &workflow); err != nil {
+		return nil
+	}
+	return &workflow
+}
+
+// 从KV中解析工作流运行，解析失败时返回nil
+func getWorkflowRunFromKv(kv *mvccpb.KeyValue) *protocol.WorkflowRun {
+
+	var run protocol.WorkflowRun
+	if err := json.Unmarshal(kv.Value, &run); err != nil || run.Workflow == nil {
+		return nil
+	}
+	return &run
+}
+
+// WorkflowManager 初始化器
+type WorkflowManagerInitializer struct {
+	Conf        baseconf.EtcdConf
+	NodeTimeout int
+}
+
+var (
+	WorkflowManager WorkflowManagerBody
+	isWFMInit       = false
+)
+
+// WorkflowManager 初始化
+func (w WorkflowManagerInitializer) Init() error {
+
+	conn, err := etcd.CreateConnect(&w.Conf)
+	if err != nil {
+		return err
+	}
+
+	WorkflowManager.Connector = *conn
+	WorkflowManager.nodeTimeout = w.NodeTimeout
+
+	isWFMInit = true
+
+	return nil
+}
+
+func CheckWorkflowManagerInit() {
+	if !isWFMInit {
+		logs.Error.Printf("workflow manager not init!")
+		os.Exit(1)
+	}
+}
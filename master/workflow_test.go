@@ -0,0 +1,151 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestValidateWorkflow(t *testing.T) {
+
+	workflow := &protocol.Workflow{
+		Name: "etl",
+		Jobs: []string{"extract", "transform", "load"},
+		Edges: []*protocol.WorkflowEdge{
+			{From: "extract", To: "transform"},
+			{From: "transform", To: "load"},
+		},
+	}
+	if err := ValidateWorkflow(workflow); err != nil {
+		t.Errorf("Error ValidateWorkflow: %v", err)
+	}
+
+	workflow.Edges = append(workflow.Edges, &protocol.WorkflowEdge{From: "load", To: "extract"})
+	if err := ValidateWorkflow(workflow); err == nil {
+		t.Errorf("Error ValidateWorkflow: cycle not reported")
+	}
+
+	workflow = &protocol.Workflow{
+		Name:  "bad",
+		Jobs:  []string{"a", "a"},
+		Edges: []*protocol.WorkflowEdge{{From: "a", To: "b", Condition: "maybe"}},
+	}
+	validation, ok := ValidateWorkflow(workflow).(*JobValidationError)
+	if !ok || len(validation.Errors) != 3 {
+		t.Errorf("Error ValidateWorkflow: %v", validation)
+	}
+
+	workflow = &protocol.Workflow{Name: "nightly", Jobs: []string{"a"}, CronExpr: "* * *"}
+	if err := ValidateWorkflow(workflow); err == nil {
+		t.Errorf("Error ValidateWorkflow: invalid cron expression accepted")
+	}
+	workflow.CronExpr, workflow.Timezone = "0 0 * * *", "Mars/Olympus"
+	if err := ValidateWorkflow(workflow); err == nil {
+		t.Errorf("Error ValidateWorkflow: unknown time zone accepted")
+	}
+}
+
+func TestDueWorkflows(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 0, 0, 30, 0, time.UTC)
+	workflows := []*protocol.Workflow{
+		{Name: "minutely", CronExpr: "* * * * *", Timezone: "UTC"},
+		{Name: "manual"},
+	}
+	plans := make(map[string]*workflowPlan)
+
+	// 新的工作流从下一个计划时间开始调度
+	if due := dueWorkflows(plans, workflows, now); len(due) != 0 || len(plans) != 1 {
+		t.Fatalf("Error dueWorkflows: due=%v plans=%d", due, len(plans))
+	}
+	if due := dueWorkflows(plans, workflows, now.Add(20*time.Second)); len(due) != 0 {
+		t.Errorf("Error dueWorkflows: fired before plan time, due=%v", due)
+	}
+	due := dueWorkflows(plans, workflows, now.Add(30*time.Second))
+	if planTime, ok := due["minutely"]; !ok || !planTime.Equal(now.Add(30*time.Second)) {
+		t.Errorf("Error dueWorkflows: due=%v", due)
+	}
+	if due := dueWorkflows(plans, workflows, now.Add(31*time.Second)); len(due) != 0 {
+		t.Errorf("Error dueWorkflows: fired twice, due=%v", due)
+	}
+
+	// 修改cron_expr后重新计算计划时间，删除cron_expr后不再调度
+	workflows[0].CronExpr = "0 * * * *"
+	_ = dueWorkflows(plans, workflows, now.Add(time.Minute))
+	if plan := plans["minutely"]; plan == nil || !plan.next.Equal(time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("Error dueWorkflows: plan not updated, plan=%+v", plan)
+	}
+	workflows[0].CronExpr = ""
+	_ = dueWorkflows(plans, workflows, now.Add(time.Hour))
+	if len(plans) != 0 {
+		t.Errorf("Error dueWorkflows: plan not removed")
+	}
+}
+
+func TestAdvanceWorkflowRun(t *testing.T) {
+
+	// extract成功后执行transform，transform失败时执行alert，最后总是执行cleanup
+	workflow := &protocol.Workflow{
+		Name: "etl",
+		Jobs: []string{"extract", "transform", "alert", "load", "cleanup"},
+		Edges: []*protocol.WorkflowEdge{
+			{From: "extract", To: "transform"},
+			{From: "transform", To: "load"},
+			{From: "transform", To: "alert", Condition: protocol.WorkflowOnFailure},
+			{From: "alert", To: "cleanup", Condition: protocol.WorkflowOnAlways},
+		},
+	}
+	run := CreateWorkflowRun(workflow, "test")
+	now := time.Now()
+
+	started := advanceWorkflowRun(run, now)
+	if len(started) != 1 || started[0] != "extract" {
+		t.Fatalf("Error advance: started %v", started)
+	}
+
+	run.Nodes["extract"].Status = protocol.WorkflowStatusSuccess
+	started = advanceWorkflowRun(run, now)
+	if len(started) != 1 || started[0] != "transform" {
+		t.Fatalf("Error advance: started %v", started)
+	}
+
+	run.Nodes["transform"].Status = protocol.WorkflowStatusFailed
+	started = advanceWorkflowRun(run, now)
+	if len(started) != 1 || started[0] != "alert" {
+		t.Fatalf("Error advance: started %v", started)
+	}
+	if run.Nodes["load"].Status != protocol.WorkflowStatusSkipped {
+		t.Errorf("Error advance: load should be skipped, got %s", run.Nodes["load"].Status)
+	}
+
+	run.Nodes["alert"].Status = protocol.WorkflowStatusSuccess
+	started = advanceWorkflowRun(run, now)
+	if len(started) != 1 || started[0] != "cleanup" {
+		t.Fatalf("Error advance: started %v", started)
+	}
+
+	run.Nodes["cleanup"].Status = protocol.WorkflowStatusSuccess
+	advanceWorkflowRun(run, now)
+	if run.Status != protocol.WorkflowStatusFailed || run.EndTime == 0 {
+		t.Errorf("Error advance: run should be failed, got %s", run.Status)
+	}
+}
+
+func TestNodeDeadline(t *testing.T) {
+
+	start := time.Now()
+	node := &protocol.WorkflowNodeState{Status: protocol.WorkflowStatusRunning, StartTime: common.ToMilli(start)}
+
+	if deadline := nodeDeadline(node, nil, 3600); deadline.Sub(start) < 3599*time.Second ||
+		deadline.Sub(start) > 3600*time.Second {
+		t.Errorf("Error nodeDeadline: deleted job deadline %v", deadline.Sub(start))
+	}
+
+	job := &protocol.Job{Name: "load", Timeout: 30, KillGrace: 10}
+	if deadline := nodeDeadline(node, job, 3600); deadline.Sub(start) > 100*time.Second ||
+		deadline.Sub(start) < 99*time.Second {
+		t.Errorf("Error nodeDeadline: job timeout deadline %v", deadline.Sub(start))
+	}
+}
@@ -111,7 +111,8 @@ $(document).ready(function () {
                     var tr = $('<tr>');
                     tr.append($('<td>').html(log.command));
                     tr.append($('<td>').html(log.err));
-                    tr.append($('<td>').html(log.output));
+                    tr.append($('<td>').text(log.stdout));
+                    tr.append($('<td>').text(log.stderr));
                     tr.append($('<td>').html(timeFormat(log.plan_time)));
                     tr.append($('<td>').html(timeFormat(log.schedule_time)));
                     tr.append($('<td>').html(timeFormat(log.exec_start_time)));
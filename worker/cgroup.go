@@ -0,0 +1,144 @@
+package worker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	JobOomKilledError     = errors.New("job is killed by oom killer")
+	CgroupNotEnabledError = errors.New("cgroup is not enabled on this worker")
+)
+
+// cpu.max使用的周期，单位为微秒
+const cgroupCpuPeriod = 100000
+
+// 准备worker的cgroup v2根目录：目录不存在时创建，并为子cgroup开启memory、cpu和pids控制器
+// 根目录必须位于cgroup2文件系统中，并且其中不能有进程，worker本身不能在这个目录中
+func initCgroupRoot(root string) error {
+
+	if runtime.GOOS != "linux" {
+		return errors.New("cgroup is only supported on linux")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(root, "cgroup.subtree_control"),
+		[]byte("+memory +cpu +pids"), 0644)
+}
+
+// 一次job执行所在的cgroup，目录名为执行的RunID
+type jobCgroup struct {
+	path string
+}
+
+// 为这一次执行创建cgroup并设置job的资源限制，worker没有开启cgroup时返回nil
+// job设置了cgroup限制但是worker没有开启cgroup时返回CgroupNotEnabledError
+func (executor *ExecutorBody) createCgroup(info *JobExecuteInfo) (*jobCgroup, error) {
+
+	if executor.cgroupRoot == "" {
+		if info.Job.Cgroup != nil {
+			return nil, CgroupNotEnabledError
+		}
+		return nil, nil
+	}
+
+	cgroup := &jobCgroup{path: filepath.Join(executor.cgroupRoot, info.RunID)}
+	if err := os.Mkdir(cgroup.path, 0755); err != nil {
+		return nil, err
+	}
+
+	limits := info.Job.Cgroup
+	if limits == nil {
+		return cgroup, nil
+	}
+
+	settings := make(map[string]string)
+	if limits.MemoryMax > 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.MemoryMax, 10)
+	}
+	if limits.CpuMax > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", int64(limits.CpuMax*cgroupCpuPeriod), cgroupCpuPeriod)
+	}
+	if limits.PidsMax > 0 {
+		settings["pids.max"] = strconv.FormatInt(limits.PidsMax, 10)
+	}
+
+	for file, value := range settings {
+		if err := cgroup.write(file, value); err != nil {
+			_ = cgroup.remove()
+			return nil, fmt.Errorf("set %s error: %v", file, err)
+		}
+	}
+	return cgroup, nil
+}
+
+// 把进程移动到cgroup中，之后进程创建的子进程也都在这个cgroup中
+func (cgroup *jobCgroup) addProcess(pid int) error {
+	return cgroup.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// 把cgroup的内存使用峰值和CPU时间填写到result中
+// memory.peak需要5.19以上的内核，读取失败时为0
+func (cgroup *jobCgroup) fillUsage(result *JobExecuteResult) {
+
+	if peak, err := cgroup.read("memory.peak"); err == nil {
+		result.MemoryPeak, _ = strconv.ParseInt(strings.TrimSpace(peak), 10, 64)
+	}
+	if cpuStat, err := cgroup.read("cpu.stat"); err == nil {
+		result.CpuUsage = time.Duration(flatKeyedValue(cpuStat, "usage_usec")) * time.Microsecond
+	}
+}
+
+// cgroup中是否有进程因为超过内存限制被OOM killer杀死
+func (cgroup *jobCgroup) oomKilled() bool {
+	events, err := cgroup.read("memory.events")
+	return err == nil && flatKeyedValue(events, "oom_kill") > 0
+}
+
+// 杀死cgroup中剩余的进程并删除cgroup
+// cgroup.kill需要5.14以上的内核，进程退出需要一点时间，因此删除失败时会重试几次
+func (cgroup *jobCgroup) remove() error {
+
+	_ = cgroup.write("cgroup.kill", "1")
+
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(cgroup.path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
+
+func (cgroup *jobCgroup) read(file string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(cgroup.path, file))
+	return string(content), err
+}
+
+func (cgroup *jobCgroup) write(file string, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroup.path, file), []byte(value), 0644)
+}
+
+// 从cgroup的flat keyed文件(每一行为"key value"，例如cpu.stat)中读取key对应的值，没有这个key时返回0
+func flatKeyedValue(content string, key string) int64 {
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseInt(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
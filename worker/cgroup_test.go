@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestCreateCgroup(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "lazycron-cgroup")
+	if err != nil {
+		t.Fatalf("Error TempDir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	job := &protocol.Job{Name: "limited", Cgroup: &protocol.CgroupLimits{MemoryMax: 1 << 20, CpuMax: 0.5}}
+	info := createTestExecuteInfo(job)
+	info.RunID = "run"
+
+	if _, err := (&ExecutorBody{}).createCgroup(info); err != CgroupNotEnabledError {
+		t.Errorf("Error createCgroup: cgroup limits accepted without cgroup root, err=%v", err)
+	}
+
+	cgroup, err := (&ExecutorBody{cgroupRoot: root}).createCgroup(info)
+	if err != nil {
+		t.Fatalf("Error createCgroup: %v", err)
+	}
+	for file, expect := range map[string]string{"memory.max": "1048576", "cpu.max": "50000 100000"} {
+		if value, err := cgroup.read(file); err != nil || value != expect {
+			t.Errorf("Error createCgroup: %s=%q err=%v", file, value, err)
+		}
+	}
+	if _, err := cgroup.read("pids.max"); err == nil {
+		t.Errorf("Error createCgroup: pids.max set without limit")
+	}
+
+	stat := "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\n"
+	if flatKeyedValue(stat, "usage_usec") != 1500 || flatKeyedValue(stat, "nr_throttled") != 0 {
+		t.Errorf("Error flatKeyedValue")
+	}
+}
+
+func TestRunInCgroup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lazycron-cgroup")
+	if err != nil {
+		t.Fatalf("Error TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 普通目录中的cgroup.procs只是一个文件，可以检查启动器在exec之前写入的进程号
+	var stdout, stderr bytes.Buffer
+	info := createTestExecuteInfo(&protocol.Job{Name: "cgroup"})
+	cmd := exec.Command("/bin/sh", "-c", "echo $$")
+	if err := runCommand(cmd, info, &jobCgroup{path: dir}, &stdout, &stderr, &JobExecuteResult{}); err != nil {
+		t.Fatalf("Error runCommand: %v, stderr=%q", err, stderr.String())
+	}
+	procs, err := ioutil.ReadFile(dir + "/cgroup.procs")
+	if err != nil || string(procs) != strings.TrimSpace(stdout.String()) {
+		t.Errorf("Error runCommand: cgroup.procs=%q pid=%q err=%v", procs, stdout.String(), err)
+	}
+
+	cmd = exec.Command("/bin/sh", "-c", "echo $$")
+	err = runCommand(cmd, info, &jobCgroup{path: dir + "/missing"}, &stdout, &stderr, &JobExecuteResult{})
+	if err == nil || !strings.Contains(err.Error(), "add process to cgroup error") {
+		t.Errorf("Error runCommand: err=%v", err)
+	}
+}
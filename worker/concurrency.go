@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+// queue策略下，每个job在本worker上最多排队等待的执行数，超过时丢弃新的执行
+const maxQueuedRuns = 100
+
+// 取得job的并发执行策略，没有设置时为禁止并发
+func concurrencyPolicy(job *protocol.Job) string {
+	if job.ConcurrencyPolicy == "" {
+		return protocol.ConcurrencyForbid
+	}
+	return job.ConcurrencyPolicy
+}
+
+// 取得job最多同时执行的实例数，返回0表示不限制
+// forbid和replace策略只允许一个实例，queue策略至少为1
+func concurrencyLimit(job *protocol.Job) int {
+
+	switch concurrencyPolicy(job) {
+	case protocol.ConcurrencyAllow:
+		return job.MaxConcurrent
+	case protocol.ConcurrencyQueue:
+		if job.MaxConcurrent > 0 {
+			return job.MaxConcurrent
+		}
+		return 1
+	default:
+		return 1
+	}
+}
+
+// 判断job在本worker上正在执行的实例数是否已经达到上限
+func (scheduler *SchedulerBody) reachConcurrencyLimit(job *protocol.Job) bool {
+	limit := concurrencyLimit(job)
+	return limit > 0 && len(scheduler.jobExecuteTable[job.Name]) >= limit
+}
+
+// 把一次执行加到执行表中
+func (scheduler *SchedulerBody) addExecuting(info *JobExecuteInfo) {
+
+	running, exists := scheduler.jobExecuteTable[info.Job.Name]
+	if !exists {
+		running = make(map[string]*JobExecuteInfo)
+		scheduler.jobExecuteTable[info.Job.Name] = running
+	}
+	running[info.RunID] = info
+}
+
+// 把一次执行从执行表中删除，job没有正在执行的实例时，删除job对应的执行表
+func (scheduler *SchedulerBody) removeExecuting(info *JobExecuteInfo) {
+
+	running, exists := scheduler.jobExecuteTable[info.Job.Name]
+	if !exists {
+		return
+	}
+	delete(running, info.RunID)
+	if len(running) == 0 {
+		delete(scheduler.jobExecuteTable, info.Job.Name)
+	}
+}
+
+// 中断job正在执行的实例，runID不为空时只中断这一次执行
+// 不指定runID时，排队等待的执行也会被丢弃
+func (scheduler *SchedulerBody) killJob(jobName string, runID string) {
+
+	for _, info := range scheduler.jobExecuteTable[jobName] {
+		if runID == "" || info.RunID == runID {
+			info.CancelFunc()
+
+			if scheduler.logJob {
+				logs.Info.Printf("killed job: name=%s run=%s", jobName, info.RunID)
+			}
+		}
+	}
+
+	if runID == "" {
+		delete(scheduler.jobQueueTable, jobName)
+	}
+}
+
+// 执行本worker上排队等待的下一次执行，如果正在执行的实例已经达到上限，则什么都不做
+func (scheduler *SchedulerBody) dequeueJob(jobName string) {
+
+	queue := scheduler.jobQueueTable[jobName]
+	if len(queue) == 0 || scheduler.reachConcurrencyLimit(queue[0].Job) {
+		return
+	}
+
+	info := queue[0]
+	if len(queue) == 1 {
+		delete(scheduler.jobQueueTable, jobName)
+	} else {
+		scheduler.jobQueueTable[jobName] = queue[1:]
+	}
+	scheduler.dispatchJob(info)
+}
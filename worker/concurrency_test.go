@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+
+	cases := []struct {
+		policy        string
+		maxConcurrent int
+		limit         int
+	}{
+		{"", 0, 1},
+		{protocol.ConcurrencyForbid, 0, 1},
+		{protocol.ConcurrencyReplace, 0, 1},
+		{protocol.ConcurrencyAllow, 0, 0},
+		{protocol.ConcurrencyAllow, 3, 3},
+		{protocol.ConcurrencyQueue, 0, 1},
+		{protocol.ConcurrencyQueue, 2, 2},
+	}
+
+	for _, c := range cases {
+		job := &protocol.Job{ConcurrencyPolicy: c.policy, MaxConcurrent: c.maxConcurrent}
+		if limit := concurrencyLimit(job); limit != c.limit {
+			t.Errorf("Error concurrencyLimit(%s, %d): %d", c.policy, c.maxConcurrent, limit)
+		}
+	}
+}
+
+func TestExecuteTable(t *testing.T) {
+
+	scheduler := SchedulerBody{
+		jobExecuteTable: make(map[string]map[string]*JobExecuteInfo),
+		jobQueueTable:   make(map[string][]*JobExecuteInfo),
+	}
+
+	job := &protocol.Job{Name: "allow", ConcurrencyPolicy: protocol.ConcurrencyAllow, MaxConcurrent: 2}
+	plan := &JobSchedulePlan{Job: job}
+
+	first := CreateJobExecuteInfo(plan, plan.NextTime)
+	second := CreateJobExecuteInfo(plan, plan.NextTime)
+
+	scheduler.addExecuting(first)
+	if scheduler.reachConcurrencyLimit(job) {
+		t.Errorf("Error reachConcurrencyLimit: one run")
+	}
+	scheduler.addExecuting(second)
+	if !scheduler.reachConcurrencyLimit(job) {
+		t.Errorf("Error reachConcurrencyLimit: two runs")
+	}
+
+	scheduler.killJob(job.Name, second.RunID)
+	if first.CancelCtx.Err() != nil || second.CancelCtx.Err() != context.Canceled {
+		t.Errorf("Error killJob: only the second run should be canceled")
+	}
+
+	scheduler.removeExecuting(first)
+	scheduler.removeExecuting(second)
+	if _, exists := scheduler.jobExecuteTable[job.Name]; exists {
+		t.Errorf("Error removeExecuting: table of job not deleted")
+	}
+}
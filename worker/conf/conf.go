@@ -6,7 +6,12 @@ type WorkerConf struct {
 	baseconf.EtcdConf
 	baseconf.RunConf
 	baseconf.MongoConf
-	LogJob bool `json:"log_job"`
+	LogJob         bool     `json:"log_job"`
+	LogLockSkipped bool     `json:"log_lock_skipped"`
+	OutputLimit    int      `json:"output_limit"`
+	StreamOutput   bool     `json:"stream_output"`
+	AllowedUsers   []string `json:"allowed_users"`
+	CgroupRoot     string   `json:"cgroup_root"`
 }
 
 func (conf *WorkerConf) SetDefault() {
@@ -15,6 +20,11 @@ func (conf *WorkerConf) SetDefault() {
 	conf.MongoConf.SetDefault()
 
 	conf.LogJob = true
+	conf.LogLockSkipped = false
+	conf.OutputLimit = 256 * 1024
+	conf.StreamOutput = false
+	conf.AllowedUsers = []string{}
+	conf.CgroupRoot = ""
 }
 
 func ReadWorkerConf(filename string) *WorkerConf {
@@ -1,23 +1,50 @@
 package worker
 
 import (
-	"math/rand"
+	"errors"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/golazycat/lazycron/common"
 	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+var JobTimeoutError = errors.New("job timed out")
+
+const (
+	// job超时或者被kill后，如果没有指定宽限时间，从SIGTERM到SIGKILL默认等待的秒数
+	defaultKillGrace = 5
+	// 发送SIGKILL之后等待进程退出的时间
+	killWaitTime = time.Second
+	// 等待进程退出时检查的间隔
+	processPollInterval = 100 * time.Millisecond
 )
 
 // 执行器结构体，执行器用于从Scheduler那里获取需要执行的job并执行
 // 执行job完毕后将执行结果返回给Scheduler，是一个中间件
+// outputLimit: job没有设置输出上限时，stdout和stderr各自默认保存的最大字节数
+// streamOutput: 是否把运行中job的输出实时推送到etcd
+// allowedUsers: job可以通过run_as使用的用户，"*"表示所有用户
+// cgroupRoot: cgroup v2根目录，每一次执行都在其中单独的cgroup中运行，为空时不使用cgroup
 type ExecutorBody struct {
+	outputLimit  int
+	streamOutput bool
+	allowedUsers []string
+	cgroupRoot   string
 }
 
 // 执行指定的job，并将执行结果返回给Scheduler
-// 执行过程会异步进行
+// 执行过程会异步进行，job依据类型由对应的JobExecutor执行
 // 注意，在执行前，需要尝试获取这个job的分布式锁，如果获取失败，说明
-// 有其他的worker正在执行这个job，则会跳过这个job的执行
+// 有其他的worker正在执行这个job，则会跳过这个job的执行(queue和replace策略会等待锁，见lockJob)
+// 执行信息中有SkipReason时，不会真正执行job，只是通过锁保证只有一个worker记录跳过的日志
+// 执行期间锁丢失时会中断job，命令通过环境变量LAZYCRON_FENCING_TOKEN得到锁的fencing token，
+// 其它注入的环境变量见jobEnv
 func (executor *ExecutorBody) Execute(info *JobExecuteInfo) {
 
 	CheckExecutorInit()
@@ -28,33 +55,92 @@ func (executor *ExecutorBody) Execute(info *JobExecuteInfo) {
 			ExecuteInfo: info,
 			StartTime:   time.Now(),
 		}
-		jobLock := CreateJobLock(info.Job.Name, &JobWorker.Connector)
+		jobLock := CreateJobLock(info, &JobWorker.Connector)
 		defer jobLock.UnLock()
 
-		// 随机睡眠，增加其他worker的竞争
-		time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+		err := lockJob(jobLock, info)
+		if err == nil {
+			err = checkFixedDelay(info)
+		}
+		if err == nil {
+			err = takeRunTicket(info)
+		}
 
-		if err := jobLock.Lock(); err != nil {
-			// 抢占锁失败，错误退出
+		if err != nil {
 			result.EndTime = time.Now()
-			result.Err = LockOccupiedError
+			if info.CancelCtx.Err() != nil {
+				// 等待锁的过程中被kill
+				result.Err = err
+				result.Status = protocol.JobStatusKilled
+			} else if err == FireClaimedError {
+				// 这一次执行已经由其它worker处理
+				result.Err = FireClaimedError
+				result.Status = protocol.JobStatusLockSkipped
+			} else if err == MaxRunsReachedError {
+				// 执行次数已经用完
+				result.Err = MaxRunsReachedError
+				result.Status = protocol.JobStatusSkipped
+			} else if err == LockOccupiedError {
+				// 抢占锁失败，错误退出
+				result.Err = LockOccupiedError
+				result.Status = protocol.JobStatusLockSkipped
+			} else {
+				// 访问etcd等其它错误，这一次执行没有进行，需要记录日志
+				result.Err = err
+				result.ExitCode = -1
+				result.Status = protocol.JobStatusFailed
+			}
+
+		} else if info.SkipReason != "" {
+			// 因为日历的限制跳过这次执行，只记录日志
+			result.EndTime = time.Now()
+			result.Status = protocol.JobStatusSkipped
+			saveLastFireTime(info)
 
 		} else {
 
 			// 抢占分布式锁需要花时间，因此这里重置开始时间
 			result.StartTime = time.Now()
+			saveLastFireTime(info)
+
+			env := jobEnv(info, jobLock.FencingToken())
+			stopWatchLock := watchLockLost(jobLock, info)
 
-			cmd := exec.CommandContext(info.CancelCtx,
-				"/bin/bash", "-c", info.Job.Command)
+			outputLimit := info.Job.OutputLimit
+			if outputLimit == 0 {
+				outputLimit = executor.outputLimit
+			}
+			stdout := newCappedBuffer(outputLimit)
+			stderr := newCappedBuffer(outputLimit)
 
-			output, err := cmd.CombinedOutput()
-			if output == nil {
-				output = make([]byte, 0)
+			jobExecutor, err := getJobExecutor(info.Job)
+			if err == nil {
+				if stream := executor.beginOutputStream(info); stream != nil {
+					err = jobExecutor.Run(info, env,
+						io.MultiWriter(stdout, stream.Writer("stdout")),
+						io.MultiWriter(stderr, stream.Writer("stderr")), &result)
+					stream.End()
+				} else {
+					err = jobExecutor.Run(info, env, stdout, stderr, &result)
+				}
+			} else {
+				result.ExitCode = -1
 			}
 
 			result.EndTime = time.Now()
-			result.Output = output
+			result.Stdout = stdout.Bytes()
+			result.Stderr = stderr.Bytes()
+			result.StdoutTruncated = stdout.Truncated()
+			result.StderrTruncated = stderr.Truncated()
 			result.Err = err
+			result.Status = executeStatus(info, err)
+			if stopWatchLock() {
+				result.Err = LockLostError
+			}
+			if info.CancelCtx.Err() != nil {
+				reportKill(info, result.KillReport)
+			}
+			saveLastFinishTime(info, result.EndTime)
 
 		}
 
@@ -63,17 +149,298 @@ func (executor *ExecutorBody) Execute(info *JobExecuteInfo) {
 
 }
 
+// 记录调度执行的计划时间，手动执行和重试不记录
+func saveLastFireTime(info *JobExecuteInfo) {
+
+	if info.Trigger != nil || info.Attempt != 1 {
+		return
+	}
+	if err := JobWorker.SaveLastFireTime(info.Job.Name, info.PlanTime); err != nil {
+		logs.Warn.Printf("save last fire time of job %s error: %s", info.Job.Name, err)
+	}
+}
+
+// 依据job的并发执行策略获取job的分布式锁
+// queue策略会一直等待，直到锁的槽位空出来；replace策略会中断持有锁的执行，然后等待它释放锁；
+// 其它策略获取失败时直接返回错误
+func lockJob(jobLock *JobLock, info *JobExecuteInfo) error {
+
+	// 在jitter延迟期间已经被kill
+	if err := info.CancelCtx.Err(); err != nil {
+		return err
+	}
+
+	switch concurrencyPolicy(info.Job) {
+	case protocol.ConcurrencyQueue:
+		return jobLock.WaitLock(info.CancelCtx, nil)
+
+	case protocol.ConcurrencyReplace:
+		return jobLock.WaitLock(info.CancelCtx, func(holders []string) {
+			for _, runID := range holders {
+				if err := JobWorker.KillRun(info.Job.Name, runID); err != nil {
+					logs.Warn.Printf("kill run %s of job %s error: %s",
+						runID, info.Job.Name, err)
+				}
+			}
+		})
+
+	default:
+		return jobLock.Lock()
+	}
+}
+
+// 监控job的分布式锁，锁丢失时中断这次执行，防止其它worker获取锁后同一个job被同时执行
+// 返回的函数用于在执行结束后停止监控，它返回这次执行是否因为锁丢失而被中断
+func watchLockLost(jobLock *JobLock, info *JobExecuteInfo) func() bool {
+
+	done := make(chan struct{})
+	lost := make(chan struct{})
+
+	go func() {
+		select {
+		case <-done:
+		case <-jobLock.Lost():
+			close(lost)
+			logs.Warn.Printf("lock of job %s is lost, kill run %s", info.Job.Name, info.RunID)
+			info.CancelFunc()
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		select {
+		case <-lost:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// 开始job运行的输出流，如果没有开启输出流或者创建失败，返回nil
+func (executor *ExecutorBody) beginOutputStream(info *JobExecuteInfo) *OutputStream {
+
+	if !executor.streamOutput {
+		return nil
+	}
+
+	stream, err := BeginOutputStream(info, &JobWorker.Connector)
+	if err != nil {
+		logs.Warn.Printf("begin output stream of job %s error: %s", info.Job.Name, err)
+		return nil
+	}
+	return stream
+}
+
+// 运行命令，命令的stdout和stderr分别写入对应的Writer
+// 命令会在单独的进程组中运行，超时或者job被kill时会结束整个进程组，而不只是命令本身，见terminateProcesses
+// 超时的情况会返回JobTimeoutError，结束进程组的过程记录在result.KillReport中
+// 命令退出后，最多再等待kill的宽限时间读取离开了进程组的子进程的输出，见outputPipes
+// job设置了run_as时以对应的用户运行；cgroup不为nil或者设置了rlimits时通过启动器启动命令，
+// 命令exec之前就已经加入cgroup并设置了资源限制，见startWithLauncher
+func runCommand(cmd *exec.Cmd, info *JobExecuteInfo, cgroup *jobCgroup, stdout io.Writer, stderr io.Writer,
+	result *JobExecuteResult) error {
+
+	job := info.Job
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if job.RunAs != nil {
+		credential, err := runAsCredential(job.RunAs, Executor.allowedUsers)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.Credential = credential
+	}
+	if job.Rlimits != nil && !rlimitsSupported {
+		return RlimitsNotSupportedError
+	}
+
+	pipes, err := openOutputPipes(cmd, stdout, stderr)
+	if err != nil {
+		return err
+	}
+
+	// 在cgroup中执行或者有资源限制时通过启动器启动，命令exec之前就已经在cgroup中并设置了资源限制
+	if cgroup != nil || job.Rlimits != nil {
+		err = startWithLauncher(cmd, cgroup, &launcherSpec{Rlimits: job.Rlimits})
+	} else {
+		err = cmd.Start()
+	}
+	pipes.closeWriters()
+	if err != nil {
+		pipes.close(0)
+		return err
+	}
+
+	done := make(chan struct{})
+	terminated := make(chan *processTermination, 1)
+	go watchCommand(cmd.Process.Pid, info, cgroup, done, terminated)
+
+	err = cmd.Wait()
+	close(done)
+	termination := <-terminated
+	pipes.close(killGrace(job))
+
+	if termination != nil {
+		result.KillReport = termination.report
+		if termination.timeout {
+			err = JobTimeoutError
+		}
+	}
+	return err
+}
+
+// 根据执行的错误得到job的执行状态
+func executeStatus(info *JobExecuteInfo, err error) string {
+
+	switch {
+	case err == nil:
+		return protocol.JobStatusSuccess
+	case err == JobTimeoutError:
+		return protocol.JobStatusTimeout
+	case err == JobOomKilledError:
+		return protocol.JobStatusOomKilled
+	case info.CancelCtx.Err() != nil:
+		return protocol.JobStatusKilled
+	default:
+		return protocol.JobStatusFailed
+	}
+}
+
+// 结束命令进程组的过程，timeout表示是因为超时而结束的
+type processTermination struct {
+	timeout bool
+	report  *protocol.JobKillReport
+}
+
+// 监控命令的执行，超时或者job被kill时结束命令的整个进程组
+// 命令结束时done会被关闭；结束了进程组时通过terminated返回结束的过程，否则返回nil
+func watchCommand(pid int, info *JobExecuteInfo, cgroup *jobCgroup, done <-chan struct{},
+	terminated chan<- *processTermination) {
+
+	var timeoutChan <-chan time.Time
+	if info.Job.Timeout > 0 {
+		timer := time.NewTimer(common.IntSecond(info.Job.Timeout))
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	termination := &processTermination{}
+	select {
+	case <-done:
+		terminated <- nil
+		return
+	case <-timeoutChan:
+		termination.timeout = true
+	case <-info.CancelCtx.Done():
+	}
+
+	termination.report = terminateProcesses(pid, cgroup, killGrace(info.Job))
+	terminated <- termination
+}
+
+// job的kill宽限时间，没有指定时为defaultKillGrace
+func killGrace(job *protocol.Job) time.Duration {
+	if job.KillGrace <= 0 {
+		return common.IntSecond(defaultKillGrace)
+	}
+	return common.IntSecond(job.KillGrace)
+}
+
+// 结束进程组：先向整个进程组发送SIGTERM，宽限时间后仍有进程存活时发送SIGKILL，
+// 在cgroup中运行时，还会通过cgroup.kill杀死离开了进程组的进程(例如调用了setsid的进程)
+// 返回的报告中记录了最后发送的信号以及进程是否全部退出
+func terminateProcesses(pid int, cgroup *jobCgroup, grace time.Duration) *protocol.JobKillReport {
+
+	report := &protocol.JobKillReport{Signal: "SIGTERM", KilledAt: common.ToMilli(time.Now())}
+	// 负数pid表示向整个进程组发送信号
+	_ = syscall.Kill(-pid, syscall.SIGTERM)
+
+	if !waitProcessesExit(pid, cgroup, grace) {
+		report.Signal = "SIGKILL"
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+		if cgroup != nil {
+			_ = cgroup.write("cgroup.kill", "1")
+		}
+		if !waitProcessesExit(pid, cgroup, killWaitTime) {
+			return report
+		}
+	}
+
+	report.Exited = true
+	report.ExitedAt = common.ToMilli(time.Now())
+	return report
+}
+
+// 等待进程组和cgroup中的进程全部退出，超过timeout仍有进程存活时返回false
+func waitProcessesExit(pid int, cgroup *jobCgroup, timeout time.Duration) bool {
+
+	deadline := time.Now().Add(timeout)
+	for processesAlive(pid, cgroup) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(processPollInterval)
+	}
+	return true
+}
+
+// 进程组或者cgroup中是否还有进程
+func processesAlive(pid int, cgroup *jobCgroup) bool {
+
+	if processGroupAlive(pid) {
+		return true
+	}
+	if cgroup != nil {
+		procs, err := cgroup.read("cgroup.procs")
+		return err == nil && strings.TrimSpace(procs) != ""
+	}
+	return false
+}
+
+// 把kill的结果写入etcd，master的kill请求会等待这些报告
+// 没有进程的job或者进程在kill之前已经结束时report为nil，直接认为已经退出
+func reportKill(info *JobExecuteInfo, report *protocol.JobKillReport) {
+
+	if report == nil {
+		now := common.ToMilli(time.Now())
+		report = &protocol.JobKillReport{Exited: true, KilledAt: now, ExitedAt: now}
+	}
+	report.JobName = info.Job.Name
+	report.RunID = info.RunID
+	report.WorkerID = Register.WorkerID()
+
+	if err := JobWorker.SaveKillReport(report); err != nil {
+		logs.Warn.Printf("save kill report of job %s error: %s", info.Job.Name, err)
+	}
+}
+
 var (
 	Executor *ExecutorBody
 	isEInit  = false
 )
 
 type ExecutorInitializer struct {
+	OutputLimit  int
+	StreamOutput bool
+	AllowedUsers []string
+	CgroupRoot   string
 }
 
 func (e ExecutorInitializer) Init() error {
 
-	Executor = &ExecutorBody{}
+	if e.CgroupRoot != "" {
+		if err := initCgroupRoot(e.CgroupRoot); err != nil {
+			return err
+		}
+	}
+
+	Executor = &ExecutorBody{
+		outputLimit:  e.OutputLimit,
+		streamOutput: e.StreamOutput,
+		allowedUsers: e.AllowedUsers,
+		cgroupRoot:   e.CgroupRoot,
+	}
 	isEInit = true
 	return nil
 }
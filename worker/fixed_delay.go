@@ -0,0 +1,85 @@
+package worker
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+// 判断job是否是固定延迟的job，这种job的下一次执行时间需要在执行结束后才能计算
+func isFixedDelay(job *protocol.Job) bool {
+	return job.ScheduleType == protocol.ScheduleDelayAfterFinish
+}
+
+// 固定延迟的job在本worker上的执行都结束后，从执行结束的时间开始计算下一次执行时间
+// 抢锁失败的worker也会从自己的结束时间开始计算，它们的执行时间总是晚于真正执行的worker，
+// 只有真正执行的worker宕机时才会由它们接替执行，见checkFixedDelay
+func (scheduler *SchedulerBody) rescheduleFixedDelay(result *JobExecuteResult) {
+
+	jobName := result.ExecuteInfo.Job.Name
+	plan, exists := scheduler.planTable[jobName]
+	if !exists || !isFixedDelay(plan.Job) {
+		return
+	}
+
+	if _, executing := scheduler.jobExecuteTable[jobName]; executing {
+		return
+	}
+
+	scheduler.reschedulePlan(plan, plan.Schedule.Next(result.EndTime))
+}
+
+// 获取到锁之后，检查固定延迟的job距离上一次执行结束(可能在其它worker上)是否已经过了间隔时间
+// 没有过间隔时间说明这一次执行已经由其它worker处理，返回FireClaimedError；手动执行和重试不检查
+func checkFixedDelay(info *JobExecuteInfo) error {
+
+	if !isFixedDelay(info.Job) || info.Trigger != nil || info.Attempt != 1 {
+		return nil
+	}
+
+	finishTime := JobWorker.GetLastFinishTime(info.Job.Name)
+	if finishTime == 0 {
+		return nil
+	}
+
+	if time.Since(common.FromMilli(finishTime)) < common.IntSecond(info.Job.Interval) {
+		return FireClaimedError
+	}
+	return nil
+}
+
+// 记录固定延迟的job执行结束的时间，其它worker依据它判断是否需要执行
+// 需要在释放锁之前调用，这样下一个获取到锁的worker一定能读到这个时间
+func saveLastFinishTime(info *JobExecuteInfo, endTime time.Time) {
+
+	if !isFixedDelay(info.Job) {
+		return
+	}
+	if err := JobWorker.SaveLastFinishTime(info.Job.Name, endTime); err != nil {
+		logs.Warn.Printf("save last finish time of job %s error: %s", info.Job.Name, err)
+	}
+}
+
+// 记录job上一次执行结束的时间
+func (jobWorker *JobWorkerBody) SaveLastFinishTime(name string, endTime time.Time) error {
+
+	_, err := jobWorker.Kv.Put(context.TODO(), common.JobFinishPrefix+name,
+		strconv.FormatInt(common.ToMilli(endTime), 10))
+	return err
+}
+
+// 获取job上一次执行结束的时间(毫秒时间戳)，没有记录或者获取失败时返回0
+func (jobWorker *JobWorkerBody) GetLastFinishTime(name string) int64 {
+
+	getResponse, err := jobWorker.Kv.Get(context.TODO(), common.JobFinishPrefix+name)
+	if err != nil || len(getResponse.Kvs) == 0 {
+		return 0
+	}
+
+	finishTime, _ := strconv.ParseInt(string(getResponse.Kvs[0].Value), 10, 64)
+	return finishTime
+}
@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+// http类型job使用的客户端
+var httpJobClient = &http.Client{}
+
+// 发送job的Http请求，响应体写入stdout，响应的状态码记录在result.HttpStatus中
+// 状态码符合预期时退出码为0，否则为1；请求失败时退出码为-1
+// job设置了超时时间时，请求超时返回JobTimeoutError，环境变量对Http请求没有作用
+type httpExecutor struct{}
+
+func (httpExecutor) Run(info *JobExecuteInfo, _ []string, stdout io.Writer, _ io.Writer,
+	result *JobExecuteResult) error {
+
+	spec := info.Job.Http
+	if spec == nil {
+		result.ExitCode = -1
+		return errors.New("http request is empty")
+	}
+
+	ctx := info.CancelCtx
+	if info.Job.Timeout > 0 {
+		var cancelFunc context.CancelFunc
+		ctx, cancelFunc = context.WithTimeout(ctx, common.IntSecond(info.Job.Timeout))
+		defer cancelFunc()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, httpMethod(spec),
+		spec.Url, strings.NewReader(spec.Body))
+	if err != nil {
+		result.ExitCode = -1
+		return err
+	}
+	for key, value := range spec.Headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := httpJobClient.Do(request)
+	if err != nil {
+		result.ExitCode = -1
+		return httpError(ctx, info, err)
+	}
+	defer response.Body.Close()
+
+	result.HttpStatus = response.StatusCode
+	if _, err := io.Copy(stdout, response.Body); err != nil {
+		result.ExitCode = -1
+		return httpError(ctx, info, err)
+	}
+
+	if !expectStatus(spec, response.StatusCode) {
+		result.ExitCode = 1
+		return fmt.Errorf("unexpected http status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// 请求的方法，默认为GET
+func httpMethod(spec *protocol.HttpRequest) string {
+	if spec.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(spec.Method)
+}
+
+// 判断响应的状态码是否符合预期，没有指定期望的状态码时2xx都符合预期
+func expectStatus(spec *protocol.HttpRequest, status int) bool {
+
+	if len(spec.ExpectStatus) == 0 {
+		return status >= 200 && status < 300
+	}
+
+	for _, expect := range spec.ExpectStatus {
+		if status == expect {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求因为job超时而失败时返回JobTimeoutError，否则返回原来的错误
+func httpError(ctx context.Context, info *JobExecuteInfo, err error) error {
+	if ctx.Err() == context.DeadlineExceeded && info.CancelCtx.Err() == nil {
+		return JobTimeoutError
+	}
+	return err
+}
@@ -0,0 +1,27 @@
+package worker
+
+import (
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/golazycat/lazycron/common"
+)
+
+// 计算调度执行在交给Executor前的延迟，延迟在[0, job.Jitter)秒之间
+// 延迟由job名称和计划时间的哈希决定，而不是真正的随机数，这样所有worker对同一次执行计算出的延迟相同，
+// 在分散执行时间的同时，worker之间仍然是同时竞争分布式锁
+// 手动触发和失败重试不需要延迟
+func jitterDelay(info *JobExecuteInfo) time.Duration {
+
+	if info.Job.Jitter <= 0 || info.Trigger != nil || info.Attempt != 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(info.Job.Name + "@" +
+		strconv.FormatInt(common.ToMilli(info.PlanTime), 10)))
+
+	window := int64(common.IntSecond(info.Job.Jitter) / time.Millisecond)
+	return time.Duration(int64(h.Sum32())%window) * time.Millisecond
+}
@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestJitterDelay(t *testing.T) {
+
+	job := &protocol.Job{Name: "report", Jitter: 30}
+	plan := &JobSchedulePlan{Job: job}
+	planTime := time.Date(2020, 2, 1, 10, 0, 0, 0, time.Local)
+
+	delay := jitterDelay(CreateJobExecuteInfo(plan, planTime))
+	if delay < 0 || delay >= 30*time.Second {
+		t.Errorf("Error jitterDelay: %s", delay)
+	}
+	if again := jitterDelay(CreateJobExecuteInfo(plan, planTime)); again != delay {
+		t.Errorf("Error jitterDelay: not stable, %s != %s", delay, again)
+	}
+
+	retryInfo := CreateJobRetryInfo(CreateJobExecuteInfo(plan, planTime))
+	if jitterDelay(retryInfo) != 0 {
+		t.Errorf("Error jitterDelay: retry should not be delayed")
+	}
+
+	job.Jitter = 0
+	if jitterDelay(CreateJobExecuteInfo(plan, planTime)) != 0 {
+		t.Errorf("Error jitterDelay: no jitter window")
+	}
+}
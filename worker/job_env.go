@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/golazycat/lazycron/common"
+)
+
+// 注入给job的标准环境变量，脚本可以通过它们得到这一次执行的上下文
+const (
+	JobNameEnv  = "LAZYCRON_JOB_NAME"
+	PlanTimeEnv = "LAZYCRON_PLAN_TIME"
+	RunIDEnv    = "LAZYCRON_RUN_ID"
+	WorkerIDEnv = "LAZYCRON_WORKER_ID"
+	AttemptEnv  = "LAZYCRON_ATTEMPT"
+)
+
+// 生成job执行的环境变量，依次为worker进程的环境变量、job的环境变量和标准环境变量
+// 同名的环境变量以后面的为准，因此job的环境变量会覆盖worker的，但是不能覆盖标准环境变量
+// PlanTime为计划时间的毫秒时间戳
+func jobEnv(info *JobExecuteInfo, fencingToken int64) []string {
+
+	env := os.Environ()
+
+	keys := make([]string, 0, len(info.Job.Env))
+	for key := range info.Job.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+info.Job.Env[key])
+	}
+
+	return append(env,
+		JobNameEnv+"="+info.Job.Name,
+		PlanTimeEnv+"="+strconv.FormatInt(common.ToMilli(info.PlanTime), 10),
+		RunIDEnv+"="+info.RunID,
+		WorkerIDEnv+"="+Register.WorkerID(),
+		AttemptEnv+"="+strconv.Itoa(info.Attempt),
+		FencingTokenEnv+"="+strconv.FormatInt(fencingToken, 10))
+}
@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+// job的执行方式，不同类型的job由不同的JobExecutor执行，见protocol.JobTypeXxx
+// Run需要在info.CancelCtx被取消时尽快返回，输出写入stdout和stderr，退出码等执行信息填写到result中
+// env为执行的环境变量，返回值为执行的错误，为nil表示执行成功
+// 无论哪种执行方式，执行结果都通过JobExecuteResult交给Scheduler，日志、重试等处理都是相同的
+type JobExecutor interface {
+	Run(info *JobExecuteInfo, env []string, stdout io.Writer, stderr io.Writer,
+		result *JobExecuteResult) error
+}
+
+// 所有job类型对应的执行方式
+var jobExecutors = map[string]JobExecutor{
+	protocol.JobTypeShell: shellExecutor{},
+	protocol.JobTypeExec:  execExecutor{},
+	protocol.JobTypeHttp:  httpExecutor{},
+}
+
+// 获取job类型对应的执行方式，没有指定类型时为shell
+func getJobExecutor(job *protocol.Job) (JobExecutor, error) {
+
+	jobType := job.Type
+	if jobType == "" {
+		jobType = protocol.JobTypeShell
+	}
+
+	jobExecutor, exists := jobExecutors[jobType]
+	if !exists {
+		return nil, fmt.Errorf("unknown job type '%s'", job.Type)
+	}
+	return jobExecutor, nil
+}
+
+// 描述job执行的内容，记录在job log中
+func jobCommand(job *protocol.Job) string {
+
+	switch job.Type {
+	case protocol.JobTypeExec:
+		return strings.Join(job.Args, " ")
+	case protocol.JobTypeHttp:
+		if job.Http == nil {
+			return ""
+		}
+		return httpMethod(job.Http) + " " + job.Http.Url
+	default:
+		return job.Command
+	}
+}
+
+// job没有指定shell时使用的shell
+const defaultShell = "/bin/bash"
+
+// 通过shell -c执行job的命令，shell由job指定，默认为/bin/bash
+type shellExecutor struct{}
+
+func (shellExecutor) Run(info *JobExecuteInfo, env []string, stdout io.Writer, stderr io.Writer,
+	result *JobExecuteResult) error {
+
+	shell := info.Job.Shell
+	if shell == "" {
+		shell = defaultShell
+	}
+
+	cmd := exec.Command(shell, "-c", info.Job.Command)
+	return runProcess(cmd, info, env, stdout, stderr, result)
+}
+
+// 不经过shell，直接执行job的参数列表，参数不需要转义
+type execExecutor struct{}
+
+func (execExecutor) Run(info *JobExecuteInfo, env []string, stdout io.Writer, stderr io.Writer,
+	result *JobExecuteResult) error {
+
+	args := info.Job.Args
+	if len(args) == 0 {
+		result.ExitCode = -1
+		return fmt.Errorf("args is empty")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	return runProcess(cmd, info, env, stdout, stderr, result)
+}
+
+// 在job的工作目录中运行进程，并把进程的退出状态填写到result中
+// 进程不通过exec.CommandContext取消，因为它只会杀死命令本身，job被kill时由runCommand结束整个进程组
+// worker开启了cgroup时进程在这一次执行单独的cgroup中运行，cgroup的资源使用情况也填写到result中，
+// 执行失败并且cgroup中发生了OOM kill时返回JobOomKilledError
+func runProcess(cmd *exec.Cmd, info *JobExecuteInfo, env []string, stdout io.Writer, stderr io.Writer,
+	result *JobExecuteResult) error {
+
+	cmd.Env = env
+	cmd.Dir = info.Job.Workdir
+
+	cgroup, err := Executor.createCgroup(info)
+	if err != nil {
+		result.ExitCode = -1
+		return err
+	}
+
+	err = runCommand(cmd, info, cgroup, stdout, stderr, result)
+	result.fillProcessState(cmd.ProcessState)
+
+	if cgroup != nil {
+		cgroup.fillUsage(result)
+		if err != nil && err != JobTimeoutError && cgroup.oomKilled() {
+			err = JobOomKilledError
+		}
+		if removeErr := cgroup.remove(); removeErr != nil {
+			logs.Warn.Printf("remove cgroup %s error: %s", cgroup.path, removeErr)
+		}
+	}
+	return err
+}
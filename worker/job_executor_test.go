@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func createTestExecuteInfo(job *protocol.Job) *JobExecuteInfo {
+	if Executor == nil {
+		Executor = &ExecutorBody{}
+	}
+	cancelCtx, cancelFunc := context.WithCancel(context.TODO())
+	return &JobExecuteInfo{Job: job, CancelCtx: cancelCtx, CancelFunc: cancelFunc, Attempt: 1}
+}
+
+func TestExecExecutor(t *testing.T) {
+
+	job := &protocol.Job{Name: "echo", Type: protocol.JobTypeExec,
+		Args: []string{"echo", "hello 'world'"}}
+	jobExecutor, err := getJobExecutor(job)
+	if err != nil {
+		t.Fatalf("Error getJobExecutor: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	result := &JobExecuteResult{}
+	if err := jobExecutor.Run(createTestExecuteInfo(job), nil, &stdout, &stderr, result); err != nil {
+		t.Fatalf("Error Run: %v", err)
+	}
+	if stdout.String() != "hello 'world'\n" || result.ExitCode != 0 {
+		t.Errorf("Error Run: stdout=%q exit=%d", stdout.String(), result.ExitCode)
+	}
+
+	if _, err := getJobExecutor(&protocol.Job{Type: "ssh"}); err == nil {
+		t.Errorf("Error getJobExecutor: unknown type accepted")
+	}
+}
+
+func TestHttpExecutor(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer server.Close()
+
+	job := &protocol.Job{Name: "ping", Type: protocol.JobTypeHttp, Http: &protocol.HttpRequest{
+		Method: "post", Url: server.URL, Headers: map[string]string{"X-Token": "secret"}}}
+
+	var stdout, stderr bytes.Buffer
+	result := &JobExecuteResult{}
+	if err := (httpExecutor{}).Run(createTestExecuteInfo(job), nil, &stdout, &stderr, result); err != nil {
+		t.Fatalf("Error Run: %v", err)
+	}
+	if stdout.String() != "pong" || result.HttpStatus != http.StatusOK {
+		t.Errorf("Error Run: body=%q status=%d", stdout.String(), result.HttpStatus)
+	}
+
+	job.Http.Headers = nil
+	result = &JobExecuteResult{}
+	if err := (httpExecutor{}).Run(createTestExecuteInfo(job), nil, &stdout, &stderr, result); err == nil ||
+		result.HttpStatus != http.StatusForbidden || result.ExitCode != 1 {
+		t.Errorf("Error Run: err=%v status=%d exit=%d", err, result.HttpStatus, result.ExitCode)
+	}
+}
+
+func TestShellExecutorEnv(t *testing.T) {
+
+	job := &protocol.Job{Name: "env", Shell: "/bin/sh", Workdir: "/",
+		Command: `echo "$(pwd) $GREETING $LAZYCRON_JOB_NAME $LAZYCRON_ATTEMPT"`,
+		Env:     map[string]string{"GREETING": "hello", "LAZYCRON_JOB_NAME": "overridden"}}
+	info := createTestExecuteInfo(job)
+
+	var stdout, stderr bytes.Buffer
+	result := &JobExecuteResult{}
+	if err := (shellExecutor{}).Run(info, jobEnv(info, 1), &stdout, &stderr, result); err != nil {
+		t.Fatalf("Error Run: %v, stderr=%q", err, stderr.String())
+	}
+	if stdout.String() != "/ hello env 1\n" {
+		t.Errorf("Error Run: stdout=%q", stdout.String())
+	}
+}
+
+func TestShellExecutorKill(t *testing.T) {
+
+	job := &protocol.Job{Name: "tree", Command: "sleep 30 & echo $!; sleep 30", KillGrace: 1}
+	info := createTestExecuteInfo(job)
+	time.AfterFunc(200*time.Millisecond, info.CancelFunc)
+
+	var stdout, stderr bytes.Buffer
+	result := &JobExecuteResult{}
+	start := time.Now()
+	if err := (shellExecutor{}).Run(info, nil, &stdout, &stderr, result); err == nil {
+		t.Fatalf("Error Run: killed job succeeded")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Error Run: kill took %v", time.Since(start))
+	}
+
+	report := result.KillReport
+	if report == nil || !report.Exited || report.Signal != "SIGTERM" {
+		t.Fatalf("Error Run: kill report=%+v", report)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	if err != nil {
+		t.Fatalf("Error Run: stdout=%q", stdout.String())
+	}
+	// 孤儿进程退出后可能还没有被init回收，僵尸进程也认为已经退出
+	if stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil &&
+		!strings.Contains(string(stat), ") Z ") {
+		t.Errorf("Error Run: grandchild %d is still alive: %s", pid, stat)
+	}
+}
+
+func TestShellExecutorDetachedChild(t *testing.T) {
+
+	// setsid的子进程离开了进程组，命令结束后它仍然持有stdout
+	job := &protocol.Job{Name: "detach", Command: "setsid sleep 30 & echo $!", KillGrace: 1}
+	info := createTestExecuteInfo(job)
+
+	var stdout, stderr bytes.Buffer
+	result := &JobExecuteResult{}
+	start := time.Now()
+	if err := (shellExecutor{}).Run(info, nil, &stdout, &stderr, result); err != nil {
+		t.Fatalf("Error Run: %v, stderr=%q", err, stderr.String())
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Error Run: run took %v", time.Since(start))
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	if err != nil {
+		t.Fatalf("Error Run: stdout=%q", stdout.String())
+	}
+	_ = syscall.Kill(pid, syscall.SIGKILL)
+}
@@ -3,48 +3,201 @@ package worker
 import (
 	"context"
 	"errors"
+	"strconv"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/golazycat/lazycron/common"
 	"github.com/golazycat/lazycron/common/etcd"
+	"github.com/golazycat/lazycron/common/protocol"
 )
 
-var LockOccupiedError = errors.New("job lock is occupied")
+var (
+	LockOccupiedError = errors.New("job lock is occupied")
+	FireClaimedError  = errors.New("job run is claimed by another worker")
+	LockLostError     = errors.New("job lock is lost")
+)
+
+// 传给命令的fencing token环境变量
+const FencingTokenEnv = "LAZYCRON_FENCING_TOKEN"
+
+// job没有指定锁的TTL时，锁租约默认的TTL，单位为秒
+const defaultLockTTL = 5
+
+// 认领一次执行的记录保存的秒数，在这段时间内其它worker不会重复执行同一个计划时间
+const fireClaimTTL = 60
+
+// 等待锁时，两次尝试获取锁之间的间隔
+const lockRetryInterval = time.Second
 
 // Job分布式锁结构
 // 分布式锁由etcd实现，对每个job都有一个锁，在执行job前，应该先尝试获取
 // 锁，获取锁成功时，表示没有其它worker在操作这个job，在操作完成之后，需要释放锁
 // 分布式锁通过etcd租约+事务来实现
+// 允许并发的job有多个锁槽位，slots为槽位数(0表示不限制)，获取到任意一个槽位即获取锁成功，
+// 槽位的value为持有锁的那一次执行的RunID
+// 因为允许并发时锁无法阻止多个worker重复执行同一个计划时间，所以在获取锁之前，
+// 需要先通过claimKey认领这一次执行，claimKey为空表示不需要认领
+// 租约续租失败(例如网络分区)时锁会丢失，此时lostChan会被关闭，见Lost
+// fencingToken为获取锁时锁key的revision，后获取锁的执行的token总是更大
+// 获取锁成功时会以锁的租约写入runningKey，master通过它得到正在执行的实例，跳过的执行没有runningKey
 type JobLock struct {
 	etcd.Connector
 
-	jobName    string
-	cancelFunc context.CancelFunc
-	keepChan   <-chan *clientv3.LeaseKeepAliveResponse
-	leaseId    clientv3.LeaseID
-	isLocked   bool
+	jobName      string
+	runID        string
+	slots        int
+	ttl          int
+	claimKey     string
+	runningKey   string
+	cancelFunc   context.CancelFunc
+	keepChan     <-chan *clientv3.LeaseKeepAliveResponse
+	leaseId      clientv3.LeaseID
+	lostChan     chan struct{}
+	fencingToken int64
+	isClaimed    bool
+	isLocked     bool
 }
 
-// 创建job分布式锁，jobName表示为哪个job创建的锁，因为锁是通过etcd实现的，所以
+// 创建job分布式锁，info表示为哪一次job执行创建的锁，因为锁是通过etcd实现的，所以
 // 需要传入可用的etcd连接对象
-func CreateJobLock(jobName string, conn *etcd.Connector) *JobLock {
-	return &JobLock{
+func CreateJobLock(info *JobExecuteInfo, conn *etcd.Connector) *JobLock {
+
+	jobLock := &JobLock{
 		Connector: *conn,
-		jobName:   jobName,
+		jobName:   info.Job.Name,
+		runID:     info.RunID,
+		slots:     concurrencyLimit(info.Job),
+		ttl:       info.Job.LockTTL,
+		lostChan:  make(chan struct{}),
 	}
+	if jobLock.ttl <= 0 {
+		jobLock.ttl = defaultLockTTL
+	}
+
+	// 跳过的执行不会真正执行job，只需要认领，不占用锁的槽位
+	if info.SkipReason != "" {
+		jobLock.slots = 0
+	} else {
+		jobLock.runningKey = common.JobRunningPrefix + info.Job.Name + "/" + info.RunID
+	}
+
+	// forbid策略下锁本身就能防止同时执行；重试由原来执行的worker负责，也不需要认领
+	// 手动触发会发给所有worker，晚收到的worker可能在第一次执行释放锁之后再次获取锁，因此需要认领，
+	// 它的PlanTime为唯一的触发时间；工作流触发的执行需要由唯一的worker上报结果，
+	// 一次性job只能执行一次，因此总是需要认领
+	needClaim := concurrencyPolicy(info.Job) != protocol.ConcurrencyForbid ||
+		info.SkipReason != "" || info.Trigger != nil || isOnceJob(info.Job)
+	if needClaim && info.Attempt == 1 {
+		jobLock.claimKey = common.JobClaimPrefix + info.Job.Name + "/" +
+			strconv.FormatInt(common.ToMilli(info.PlanTime), 10)
+	}
+
+	return jobLock
 }
 
 // 对job上锁。成功调用这个函数之后，其它worker再对这个job调用该函数时，会返回LockOccupiedError
 // 因此，如果在调用的时候返回LockOccupiedError，表示这个job被其它worker占用了，不应该处理之
+// 如果这一次执行已经被其它worker认领，返回FireClaimedError
 // 在调用Lock函数后，job处理完成之后应该调用UnLock函数释放锁，否则其它worker将一直无法获取锁
 // 注意这个锁并不是阻塞的，获取失败返回error，函数并不会阻塞住
 func (jobLock *JobLock) Lock() error {
 
+	if err := jobLock.claim(); err != nil {
+		return err
+	}
+
+	if err := jobLock.grant(); err != nil {
+		return err
+	}
+
+	if _, err := jobLock.acquire(); err != nil {
+		jobLock.cancelLock()
+		return err
+	}
+
+	jobLock.isLocked = true
+	return nil
+}
+
+// 阻塞地对job上锁，锁的槽位都被占用时，每隔一段时间重新尝试，直到获取锁成功或者ctx被取消
+// 每次获取失败时会以占用槽位的RunID调用onOccupied(不为nil时)，replace策略通过它中断正在执行的实例
+// 如果这一次执行已经被其它worker认领，返回FireClaimedError；ctx被取消时返回ctx的错误
+func (jobLock *JobLock) WaitLock(ctx context.Context, onOccupied func(holders []string)) error {
+
+	if err := jobLock.claim(); err != nil {
+		return err
+	}
+
+	if err := jobLock.grant(); err != nil {
+		return err
+	}
+
+	for {
+		holders, err := jobLock.acquire()
+		if err == nil {
+			jobLock.isLocked = true
+			return nil
+		}
+		if err != LockOccupiedError {
+			jobLock.cancelLock()
+			return err
+		}
+
+		if onOccupied != nil {
+			onOccupied(holders)
+		}
+
+		select {
+		case <-ctx.Done():
+			jobLock.cancelLock()
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// 认领这一次执行，只有第一个认领的worker会执行它
+// 认领记录不会在执行结束后删除，而是在一段时间后自动过期，这样晚到的worker也不会重复执行
+func (jobLock *JobLock) claim() error {
+
+	if jobLock.claimKey == "" || jobLock.isClaimed {
+		return nil
+	}
+
+	leaseResponse, err := jobLock.Lease.Grant(context.TODO(), fireClaimTTL)
+	if err != nil {
+		return err
+	}
+
+	txnResponse, err := jobLock.Kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(jobLock.claimKey), "=", 0)).
+		Then(clientv3.OpPut(jobLock.claimKey, jobLock.runID,
+			clientv3.WithLease(leaseResponse.ID))).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	if !txnResponse.Succeeded {
+		_, _ = jobLock.Lease.Revoke(context.TODO(), leaseResponse.ID)
+		return FireClaimedError
+	}
+
+	jobLock.isClaimed = true
+	jobLock.fencingToken = txnResponse.Header.Revision
+	return nil
+}
+
+// 创建锁使用的租约，并自动续租
+// 续租失败时续租的channel会被关闭，如果不是主动释放锁，说明租约已经过期，锁已经丢失
+func (jobLock *JobLock) grant() error {
+
 	cancelCtx, cancelFunc := context.WithCancel(context.TODO())
 	jobLock.cancelFunc = cancelFunc
 
 	// 租约，让lock限时存在
-	leaseResponse, err := jobLock.Lease.Grant(context.TODO(), 5)
+	leaseResponse, err := jobLock.Lease.Grant(context.TODO(), int64(jobLock.ttl))
 	if err != nil {
 		return err
 	}
@@ -64,36 +217,93 @@ func (jobLock *JobLock) Lock() error {
 				break
 			}
 		}
+
+		// 不限制槽位时没有锁，租约丢失也不需要处理
+		if cancelCtx.Err() == nil && jobLock.slots > 0 {
+			close(jobLock.lostChan)
+		}
 	}()
 
-	// 创建事务
-	txn := jobLock.Kv.Txn(context.TODO())
+	return nil
+}
 
-	lockKey := common.JobLockPrefix + jobLock.jobName
-	txn.If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
-		Then(clientv3.OpPut(lockKey, "", clientv3.WithLease(jobLock.leaseId))).
-		Else(clientv3.OpGet(lockKey))
+// 锁丢失时会被关闭的channel，持有锁的执行应该在锁丢失时立即停止，因为其它worker可能已经获取了锁
+func (jobLock *JobLock) Lost() <-chan struct{} {
+	return jobLock.lostChan
+}
 
-	// 提交事务
-	txnResponse, err := txn.Commit()
-	if err != nil {
-		jobLock.cancelLock()
-		return err
+// 获取锁时得到的fencing token，它在整个集群中单调递增，job可以用它拒绝来自旧的锁持有者的写入
+// 不限制槽位时为认领这次执行时的revision，没有锁也没有认领时为0
+func (jobLock *JobLock) FencingToken() int64 {
+	return jobLock.fencingToken
+}
+
+// 依次尝试获取锁的每一个槽位，全部被占用时返回LockOccupiedError以及占用槽位的RunID
+// 槽位数不限制时不需要获取槽位，只写入runningKey；否则runningKey和槽位在同一个事务中写入
+func (jobLock *JobLock) acquire() ([]string, error) {
+
+	if jobLock.slots <= 0 {
+		for _, op := range jobLock.runningOps() {
+			if _, err := jobLock.Kv.Do(context.TODO(), op); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
 	}
 
-	if !txnResponse.Succeeded {
-		// 锁被占用
-		jobLock.cancelLock()
-		return LockOccupiedError
+	holders := make([]string, 0, jobLock.slots)
+	for slot := 0; slot < jobLock.slots; slot++ {
+
+		// 创建事务
+		txn := jobLock.Kv.Txn(context.TODO())
+
+		lockKey := jobLock.slotKey(slot)
+		txn.If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
+			Then(append(jobLock.runningOps(),
+				clientv3.OpPut(lockKey, jobLock.runID, clientv3.WithLease(jobLock.leaseId)))...).
+			Else(clientv3.OpGet(lockKey))
+
+		// 提交事务
+		txnResponse, err := txn.Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		if txnResponse.Succeeded {
+			jobLock.fencingToken = txnResponse.Header.Revision
+			return nil, nil
+		}
+
+		// 槽位被占用
+		for _, kv := range txnResponse.Responses[0].GetResponseRange().Kvs {
+			holders = append(holders, string(kv.Value))
+		}
 	}
 
-	jobLock.isLocked = true
+	return holders, LockOccupiedError
+}
 
-	return nil
+// 写入runningKey的操作，没有runningKey时为空
+func (jobLock *JobLock) runningOps() []clientv3.Op {
+	if jobLock.runningKey == "" {
+		return nil
+	}
+	return []clientv3.Op{clientv3.OpPut(jobLock.runningKey, "", clientv3.WithLease(jobLock.leaseId))}
+}
+
+// 锁槽位的key，第一个槽位和不允许并发的job的锁使用相同的key
+func (jobLock *JobLock) slotKey(slot int) string {
+	if slot == 0 {
+		return common.JobLockPrefix + jobLock.jobName
+	}
+	return common.JobLockPrefix + jobLock.jobName + "/" + strconv.Itoa(slot)
 }
 
 // 释放锁的具体实现
 func (jobLock *JobLock) cancelLock() {
+	if jobLock.cancelFunc == nil {
+		return
+	}
 	jobLock.cancelFunc()
 	_, _ = jobLock.Lease.Revoke(context.TODO(), jobLock.leaseId)
 }
@@ -2,7 +2,11 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/mvcc/mvccpb"
@@ -25,26 +29,67 @@ type watchHandleFunc func(*clientv3.Event)
 // 调用该函数，首先会遍历所有的job，并将这些job保存为job update事件提交给scheduler
 // 随后，从遍历的最后一个job的revision开始，调用etcd的watcher监听job的变化
 // 当job产生变化，该函数会创建一个job变化事件，并将该事件提交给scheduler执行
+// 日历也以同样的方式先全部读取，再持续监听变化
+// job的update事件中带有job上一次执行的计划时间和已经调度执行的次数
 func (jobWorker *JobWorkerBody) BeginWatchJobs() error {
 
 	CheckJobWorkerInit()
 
+	calendarResponse, err := jobWorker.Kv.Get(context.TODO(),
+		common.CalendarPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, kv := range calendarResponse.Kvs {
+		if calendar := common.GetCalendarFromKv(kv); calendar != nil {
+			jobEvent := protocol.CreateJobEvent(protocol.JobEventCalendarUpdate, nil)
+			jobEvent.Calendar = calendar
+			Scheduler.PushEvent(jobEvent)
+		}
+	}
+
 	getResponse, err := jobWorker.Kv.Get(context.TODO(),
 		common.JobKeyPrefix, clientv3.WithPrefix())
 	if err != nil {
 		return err
 	}
 
+	firedResponse, err := jobWorker.Kv.Get(context.TODO(),
+		common.JobFiredPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	lastFireTimes := make(map[string]int64, len(firedResponse.Kvs))
+	for _, kv := range firedResponse.Kvs {
+		name, lastFireTime := common.GetLastFireTimeFromKv(kv)
+		lastFireTimes[name] = lastFireTime
+	}
+
+	runCountResponse, err := jobWorker.Kv.Get(context.TODO(),
+		common.JobRunCountPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	runCounts := make(map[string]int64, len(runCountResponse.Kvs))
+	for _, kv := range runCountResponse.Kvs {
+		runCounts[strings.TrimPrefix(string(kv.Key), common.JobRunCountPrefix)] = kv.Version
+	}
+
 	for _, kv := range getResponse.Kvs {
 		if job := common.GetJobFromKv(kv); job != nil {
 
 			jobEvent := protocol.CreateJobEvent(protocol.JobEventUpdate, job)
+			jobEvent.LastFireTime = lastFireTimes[job.Name]
+			jobEvent.RunCount = runCounts[job.Name]
 			Scheduler.PushEvent(jobEvent)
 		}
 	}
 
 	go jobWorker.keepWatchJobs(getResponse.Header.Revision)
 	go jobWorker.keepWatchKills()
+	go jobWorker.keepWatchRuns()
+	go jobWorker.keepWatch(common.CalendarPrefix,
+		calendarResponse.Header.Revision, jobWorker.handleCalendarWatchEvent)
 
 	return nil
 }
@@ -62,6 +107,12 @@ func (jobWorker *JobWorkerBody) handleJobWatchEvent(event *clientv3.Event) {
 		}
 
 		jobEvent = protocol.CreateJobEvent(protocol.JobEventUpdate, job)
+		if job.Misfire != nil || isOnceJob(job) {
+			jobEvent.LastFireTime = jobWorker.GetLastFireTime(job.Name)
+		}
+		if job.MaxRuns > 0 {
+			jobEvent.RunCount = jobWorker.GetRunCount(job.Name)
+		}
 
 	case mvccpb.DELETE:
 		joName := common.GetJobNameFromKv(event.Kv)
@@ -80,6 +131,7 @@ func (jobWorker *JobWorkerBody) handleJobWatchEvent(event *clientv3.Event) {
 }
 
 // 处理一个新的kill请求，转换为jobEvent，发送给Scheduler处理
+// kill请求的value为空时中断job所有的执行，否则value为需要中断的那一次执行的RunID
 func (jobWorker *JobWorkerBody) handleKillWatchEvent(event *clientv3.Event) {
 
 	if event.Type == mvccpb.PUT {
@@ -87,11 +139,112 @@ func (jobWorker *JobWorkerBody) handleKillWatchEvent(event *clientv3.Event) {
 		jobName := common.GetJobNameFromKill(event.Kv)
 		jobEvent := protocol.CreateJobEvent(protocol.JobEventKill,
 			&protocol.Job{Name: jobName})
+		jobEvent.RunID = string(event.Kv.Value)
 		Scheduler.PushEvent(jobEvent)
 	}
 
 }
 
+// 处理一个新的手动触发请求，转换为jobEvent，发送给Scheduler处理
+func (jobWorker *JobWorkerBody) handleRunWatchEvent(event *clientv3.Event) {
+
+	if event.Type == mvccpb.PUT {
+
+		var trigger protocol.JobTrigger
+		if err := json.Unmarshal(event.Kv.Value, &trigger); err != nil {
+			return
+		}
+
+		jobName := common.GetJobNameFromRun(event.Kv)
+		jobEvent := protocol.CreateJobEvent(protocol.JobEventRun,
+			&protocol.Job{Name: jobName})
+		jobEvent.Trigger = &trigger
+		Scheduler.PushEvent(jobEvent)
+	}
+
+}
+
+// 中断job的某一次执行，用于replace并发策略中断其它worker上正在执行的实例
+// 和master的kill请求一样，kill的kv只会存在1秒的时间
+func (jobWorker *JobWorkerBody) KillRun(name string, runID string) error {
+
+	leaseGrantResponse, err := jobWorker.Lease.Grant(context.TODO(), 1)
+	if err != nil {
+		return err
+	}
+
+	_, err = jobWorker.Kv.Put(context.TODO(), common.JobKillPrefix+name,
+		runID, clientv3.WithLease(leaseGrantResponse.ID))
+	return err
+}
+
+// kill报告的租约时间，单位为秒，master只在kill请求期间等待报告
+const killReportTTL = 60
+
+// 保存一次执行的kill结果，key为JobKillReportPrefix/jobName/runId
+func (jobWorker *JobWorkerBody) SaveKillReport(report *protocol.JobKillReport) error {
+
+	value, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	leaseGrantResponse, err := jobWorker.Lease.Grant(context.TODO(), killReportTTL)
+	if err != nil {
+		return err
+	}
+
+	_, err = jobWorker.Kv.Put(context.TODO(),
+		common.JobKillReportPrefix+report.JobName+"/"+report.RunID,
+		string(value), clientv3.WithLease(leaseGrantResponse.ID))
+	return err
+}
+
+// 处理一个日历的变化，转换为jobEvent，发送给Scheduler处理
+func (jobWorker *JobWorkerBody) handleCalendarWatchEvent(event *clientv3.Event) {
+
+	var jobEvent *protocol.JobEvent
+
+	switch event.Type {
+	case mvccpb.PUT:
+		calendar := common.GetCalendarFromKv(event.Kv)
+		if calendar == nil {
+			return
+		}
+		jobEvent = protocol.CreateJobEvent(protocol.JobEventCalendarUpdate, nil)
+		jobEvent.Calendar = calendar
+
+	case mvccpb.DELETE:
+		jobEvent = protocol.CreateJobEvent(protocol.JobEventCalendarDelete, nil)
+		jobEvent.Calendar = &protocol.Calendar{Name: common.GetCalendarNameFromKv(event.Kv)}
+
+	default:
+		return
+	}
+
+	Scheduler.PushEvent(jobEvent)
+}
+
+// 记录job上一次被执行的计划时间，用于重启的worker发现错过的执行
+func (jobWorker *JobWorkerBody) SaveLastFireTime(name string, planTime time.Time) error {
+
+	_, err := jobWorker.Kv.Put(context.TODO(), common.JobFiredPrefix+name,
+		strconv.FormatInt(common.ToMilli(planTime), 10))
+	return err
+}
+
+// 获取job上一次被执行的计划时间(毫秒时间戳)，没有记录或者获取失败时返回0
+func (jobWorker *JobWorkerBody) GetLastFireTime(name string) int64 {
+
+	getResponse, err := jobWorker.Kv.Get(context.TODO(), common.JobFiredPrefix+name)
+	if err != nil || len(getResponse.Kvs) == 0 {
+		return 0
+	}
+
+	_, lastFireTime := common.GetLastFireTimeFromKv(getResponse.Kvs[0])
+	return lastFireTime
+}
+
 // 当初始jobs读取完成后，会获得最后的一个revision，该函数从最后的revision的下一个开始进行
 // 监听。当job发生变化，会根据变化创建对应的事件，并将事件提交给scheduler执行
 // initLastRevision指定了初始化的最后一个revision
@@ -104,6 +257,11 @@ func (jobWorker *JobWorkerBody) keepWatchKills() {
 	jobWorker.keepWatch(common.JobKillPrefix, -1, jobWorker.handleKillWatchEvent)
 }
 
+// 持续监听手动触发请求，当监听到master发送的触发请求时，进行处理
+func (jobWorker *JobWorkerBody) keepWatchRuns() {
+	jobWorker.keepWatch(common.JobRunPrefix, -1, jobWorker.handleRunWatchEvent)
+}
+
 // 辅助函数，在etcd监听某个key的变化，需要传入对应的变化处理函数
 // initLastRevision表示从哪个revision开始监听，如果从默认的revision开始监听，传-1
 func (jobWorker *JobWorkerBody) keepWatch(watchKey string, initLastRevision int64, handleFunc watchHandleFunc) {
@@ -0,0 +1,137 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+const (
+	// 启动器进程的argv[0]，worker以这个名称重新执行自身时作为启动器运行
+	launcherName = "lazycron-launcher"
+	// 启动器向worker报告错误使用的文件描述符，exec成功后会被关闭
+	launcherErrorFd = 3
+	// 启动器等待worker完成准备使用的文件描述符，worker写入一个字节后启动器才会继续
+	launcherStartFd = 4
+	// 启动器在exec之前失败时的退出码
+	launcherFailedCode = 127
+	// 重新执行worker自身使用的路径，不需要run_as的用户能访问worker所在的目录，worker被替换后也能使用
+	// 只有linux支持cgroup和rlimits，其它系统不会使用启动器
+	launcherExecutable = "/proc/self/exe"
+)
+
+// 启动器的配置
+// Rlimits: 启动器设置的资源限制，为空时不设置
+type launcherSpec struct {
+	Rlimits *protocol.Rlimits `json:"rlimits"`
+}
+
+// 命令需要在exec之前做一些准备时(加入cgroup、设置资源限制)，worker不直接启动命令，而是以启动器的身份重新执行自身，
+// 启动器启动后先等待worker把它的进程号写入cgroup，再设置资源限制并exec真正的命令，
+// run_as的用户由内核在fork启动器时切换(SysProcAttr.Credential)，启动器本身不切换用户，
+// 命令的进程号不变，从第一条指令开始就处于准备好的环境中，它fork出的子进程也不会在加入cgroup之前逃逸
+// 启动器的参数为: 启动器名称 配置JSON 命令路径 命令的argv...
+func init() {
+	if len(os.Args) > 1 && os.Args[0] == launcherName {
+		runLauncher(os.Args[1:])
+	}
+}
+
+// 作为启动器运行，只有出错时才会返回，此时通过launcherErrorFd报告错误并退出
+func runLauncher(args []string) {
+
+	errorPipe := os.NewFile(launcherErrorFd, "launcher-error")
+	err := launch(args)
+	_, _ = errorPipe.WriteString(err.Error())
+	os.Exit(launcherFailedCode)
+}
+
+func launch(args []string) error {
+
+	if len(args) < 3 {
+		return errors.New("launcher arguments missing")
+	}
+	var spec launcherSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		return fmt.Errorf("parse launcher spec error: %v", err)
+	}
+
+	// worker完成准备之前退出时读取不到数据
+	start := make([]byte, 1)
+	if n, _ := os.NewFile(launcherStartFd, "launcher-start").Read(start); n != 1 {
+		return errors.New("launcher is not started by worker")
+	}
+
+	if spec.Rlimits != nil {
+		if err := setRlimits(spec.Rlimits); err != nil {
+			return fmt.Errorf("set rlimits error: %v", err)
+		}
+	}
+
+	syscall.CloseOnExec(launcherErrorFd)
+	syscall.CloseOnExec(launcherStartFd)
+	if err := syscall.Exec(args[1], args[2:], os.Environ()); err != nil {
+		return fmt.Errorf("exec %s: %v", args[1], err)
+	}
+	return nil
+}
+
+// 通过启动器启动命令，返回时命令已经exec，或者启动器出错并已经退出
+// cgroup不为nil时，由worker在启动器exec之前把它的进程号写入cgroup，启动器本身不需要cgroup的写权限
+func startWithLauncher(cmd *exec.Cmd, cgroup *jobCgroup, spec *launcherSpec) error {
+
+	specValue, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	errorReader, errorWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer errorReader.Close()
+	startReader, startWriter, err := os.Pipe()
+	if err != nil {
+		_ = errorWriter.Close()
+		return err
+	}
+	defer startWriter.Close()
+
+	cmd.Args = append([]string{launcherName, string(specValue), cmd.Path}, cmd.Args...)
+	cmd.Path = launcherExecutable
+	cmd.ExtraFiles = []*os.File{errorWriter, startReader}
+
+	err = cmd.Start()
+	_ = errorWriter.Close()
+	_ = startReader.Close()
+	if err != nil {
+		return err
+	}
+
+	if cgroup != nil {
+		if err := cgroup.addProcess(cmd.Process.Pid); err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return fmt.Errorf("add process to cgroup error: %v", err)
+		}
+	}
+	if _, err := startWriter.Write([]byte{1}); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	// exec成功后管道被关闭，读取到EOF
+	message, _ := ioutil.ReadAll(errorReader)
+	if len(message) > 0 {
+		_ = cmd.Wait()
+		return errors.New(string(message))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+const (
+	// 没有指定错过执行阈值时的默认阈值，单位为秒
+	defaultMisfireThreshold = 5
+	// 没有指定补执行次数上限时，run_all策略默认最多补执行的次数
+	defaultMisfireLimit = 10
+	// 计算错过的执行时，最多检查多少个计划时间，防止长时间停机后计算过多
+	maxMisfireScan = 10000
+)
+
+// 执行到期的job计划，并根据job的错过执行策略处理错过的执行
+// 计划时间距离now超过阈值的执行被认为是错过的执行，没有设置策略的job保持原有的行为：只执行一次最早到期的计划
+// 固定延迟的job没有错过的执行，总是只执行一次
+func (scheduler *SchedulerBody) fireJob(plan *JobSchedulePlan, now time.Time) {
+
+	policy := plan.Job.Misfire
+	if policy == nil || isFixedDelay(plan.Job) {
+		scheduler.executeJob(CreateJobExecuteInfo(plan, plan.NextTime))
+		return
+	}
+
+	onTime, missed := dueFireTimes(plan, now)
+
+	fireTimes := make([]time.Time, 0)
+	switch policy.Policy {
+	case protocol.MisfireRunOnce:
+		if len(onTime) == 0 && len(missed) != 0 {
+			fireTimes = append(fireTimes, missed[len(missed)-1])
+		}
+	case protocol.MisfireRunAll:
+		limit := policy.Limit
+		if limit <= 0 {
+			limit = defaultMisfireLimit
+		}
+		if len(missed) > limit {
+			missed = missed[len(missed)-limit:]
+		}
+		fireTimes = append(fireTimes, missed...)
+	}
+	if len(onTime) != 0 {
+		fireTimes = append(fireTimes, onTime[len(onTime)-1])
+	}
+
+	if len(missed) != 0 && scheduler.logJob {
+		logs.Warn.Printf("job misfired: name=%s missed=%d policy=%s fire=%d",
+			plan.Job.Name, len(missed), policy.Policy, len(fireTimes))
+	}
+
+	if len(fireTimes) == 1 && len(plan.Pending) == 0 {
+		scheduler.executeJob(CreateJobExecuteInfo(plan, fireTimes[0]))
+		return
+	}
+
+	// 需要补执行多次时，依次排队执行，上一次执行结束后才会执行下一次
+	plan.Pending = append(plan.Pending, fireTimes...)
+	if limit := policy.Limit; limit > 0 && len(plan.Pending) > limit+1 {
+		plan.Pending = plan.Pending[len(plan.Pending)-limit-1:]
+	}
+	scheduler.executePending(plan)
+}
+
+// 执行计划中排队等待的下一次执行，如果job正在执行，则什么都不做，等待执行结束后再调用
+func (scheduler *SchedulerBody) executePending(plan *JobSchedulePlan) {
+
+	if len(plan.Pending) == 0 {
+		return
+	}
+	if _, executing := scheduler.jobExecuteTable[plan.Job.Name]; executing {
+		return
+	}
+
+	planTime := plan.Pending[0]
+	plan.Pending = plan.Pending[1:]
+	scheduler.executeJob(CreateJobExecuteInfo(plan, planTime))
+}
+
+// 计算计划中到now为止所有到期的计划时间，并按照错过执行阈值分为按时的执行和错过的执行
+// 两个列表都按照时间先后排序
+func dueFireTimes(plan *JobSchedulePlan, now time.Time) ([]time.Time, []time.Time) {
+
+	threshold := common.IntSecond(plan.Job.Misfire.Threshold)
+	if threshold <= 0 {
+		threshold = common.IntSecond(defaultMisfireThreshold)
+	}
+
+	onTime := make([]time.Time, 0)
+	missed := make([]time.Time, 0)
+
+	fireTime := plan.NextTime
+	for i := 0; i < maxMisfireScan && !fireTime.IsZero() && !fireTime.After(now); i++ {
+		if now.Sub(fireTime) > threshold {
+			missed = append(missed, fireTime)
+		} else {
+			onTime = append(onTime, fireTime)
+		}
+		fireTime = plan.Schedule.Next(fireTime)
+	}
+
+	return onTime, missed
+}
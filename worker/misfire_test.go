@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestDueFireTimes(t *testing.T) {
+
+	job := &protocol.Job{Name: "minutely", CronExpr: "* * * * *",
+		Misfire: &protocol.MisfirePolicy{Policy: protocol.MisfireRunAll, Threshold: 10}}
+
+	now := time.Date(2020, 2, 1, 10, 0, 5, 0, time.Local)
+	lastFireTime := time.Date(2020, 2, 1, 9, 55, 0, 0, time.Local)
+
+	plan, err := CreateJobSchedulerPlan(job, lastFireTime, 0)
+	if err != nil {
+		t.Fatalf("Error CreateJobSchedulerPlan: %v", err)
+	}
+	if !plan.NextTime.Equal(lastFireTime.Add(time.Minute)) {
+		t.Fatalf("Error NextTime: %v", plan.NextTime)
+	}
+
+	onTime, missed := dueFireTimes(plan, now)
+	if len(onTime) != 1 || !onTime[0].Equal(time.Date(2020, 2, 1, 10, 0, 0, 0, time.Local)) {
+		t.Errorf("Error onTime: %v", onTime)
+	}
+	if len(missed) != 4 || !missed[0].Equal(lastFireTime.Add(time.Minute)) {
+		t.Errorf("Error missed: %v", missed)
+	}
+}
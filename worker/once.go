@@ -0,0 +1,94 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+// 一次性job没有指定CompletedTTL时，标记为已完成后默认保留的秒数
+const defaultCompletedTTL = 7 * 24 * 3600
+
+// 判断job是否是只执行一次的job
+func isOnceJob(job *protocol.Job) bool {
+	return job.ScheduleType == protocol.ScheduleOnce
+}
+
+// 判断一次执行结果是否需要把一次性job标记为已完成
+// 只有调度执行成功才算完成，手动执行、失败和跳过的执行都不会改变job
+func shouldComplete(result *JobExecuteResult) bool {
+
+	info := result.ExecuteInfo
+	return isOnceJob(info.Job) && info.Trigger == nil &&
+		result.Err == nil && result.Status == protocol.JobStatusSuccess
+}
+
+// 一次性job执行成功后，把job标记为已完成，设置了AutoDelete时直接删除job
+// 已完成的job和它的执行时间记录绑定同一个租约，在CompletedTTL秒之后被etcd自动删除
+// 如果job在执行期间被修改了执行时间，说明需要重新执行，不会标记
+func (jobWorker *JobWorkerBody) CompleteOnceJob(job *protocol.Job) {
+
+	if err := jobWorker.completeOnceJob(job); err != nil {
+		logs.Warn.Printf("complete one-shot job %s error: %s", job.Name, err)
+	}
+}
+
+func (jobWorker *JobWorkerBody) completeOnceJob(job *protocol.Job) error {
+
+	jobKey := common.JobKeyPrefix + job.Name
+	firedKey := common.JobFiredPrefix + job.Name
+
+	getResponse, err := jobWorker.Kv.Get(context.TODO(), jobKey)
+	if err != nil {
+		return err
+	}
+	if len(getResponse.Kvs) == 0 {
+		return nil
+	}
+
+	kv := getResponse.Kvs[0]
+	current := common.GetJobFromKv(kv)
+	if current == nil || !isOnceJob(current) || current.Completed || current.RunAt != job.RunAt {
+		return nil
+	}
+
+	var ops []clientv3.Op
+	if current.AutoDelete {
+		ops = []clientv3.Op{clientv3.OpDelete(jobKey), clientv3.OpDelete(firedKey)}
+	} else {
+		ttl := current.CompletedTTL
+		if ttl <= 0 {
+			ttl = defaultCompletedTTL
+		}
+		leaseResponse, err := jobWorker.Lease.Grant(context.TODO(), int64(ttl))
+		if err != nil {
+			return err
+		}
+
+		current.Completed = true
+		current.CompletedAt = common.ToMilli(time.Now())
+		jobValue, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		ops = []clientv3.Op{
+			clientv3.OpPut(jobKey, string(jobValue), clientv3.WithLease(leaseResponse.ID)),
+			clientv3.OpPut(firedKey, strconv.FormatInt(current.RunAt, 10),
+				clientv3.WithLease(leaseResponse.ID)),
+		}
+	}
+
+	// job在读取之后被修改过时放弃，保留新的job
+	_, err = jobWorker.Kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", kv.ModRevision)).
+		Then(ops...).
+		Commit()
+	return err
+}
@@ -0,0 +1,182 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// 有容量上限的输出缓冲区，实现了io.Writer接口，用于保存job的stdout或者stderr
+// 输出不超过上限时会完整保存；超过上限时只保留开头和结尾各一半的内容，中间的部分被丢弃
+// 结尾部分使用环形缓冲区保存，因此无论job输出多少，缓冲区占用的内存都不会超过上限
+// limit小于等于0表示不限制输出大小
+type cappedBuffer struct {
+	limit int
+	head  []byte
+
+	tail    []byte
+	tailPos int
+	tailLen int
+
+	total int64
+}
+
+// 创建一个输出缓冲区，limit为保存的最大字节数
+func newCappedBuffer(limit int) *cappedBuffer {
+	return &cappedBuffer{limit: limit}
+}
+
+// 写入输出，永远不会返回错误
+func (buffer *cappedBuffer) Write(p []byte) (int, error) {
+
+	n := len(p)
+	buffer.total += int64(n)
+
+	if buffer.limit <= 0 {
+		buffer.head = append(buffer.head, p...)
+		return n, nil
+	}
+
+	headLimit := buffer.limit - buffer.limit/2
+	if len(buffer.head) < headLimit {
+		size := headLimit - len(buffer.head)
+		if size > len(p) {
+			size = len(p)
+		}
+		buffer.head = append(buffer.head, p[:size]...)
+		p = p[size:]
+	}
+
+	if len(p) > 0 {
+		buffer.writeTail(p)
+	}
+
+	return n, nil
+}
+
+// 写入结尾部分的环形缓冲区
+func (buffer *cappedBuffer) writeTail(p []byte) {
+
+	tailLimit := buffer.limit / 2
+	if tailLimit == 0 {
+		return
+	}
+	if buffer.tail == nil {
+		buffer.tail = make([]byte, tailLimit)
+	}
+
+	if len(p) >= tailLimit {
+		copy(buffer.tail, p[len(p)-tailLimit:])
+		buffer.tailPos = 0
+		buffer.tailLen = tailLimit
+		return
+	}
+
+	for len(p) > 0 {
+		n := copy(buffer.tail[buffer.tailPos:], p)
+		buffer.tailPos = (buffer.tailPos + n) % tailLimit
+		buffer.tailLen += n
+		p = p[n:]
+	}
+	if buffer.tailLen > tailLimit {
+		buffer.tailLen = tailLimit
+	}
+}
+
+// 输出是否超过了上限，有部分内容被丢弃
+func (buffer *cappedBuffer) Truncated() bool {
+	return buffer.total > int64(len(buffer.head)+buffer.tailLen)
+}
+
+// 取得保存的输出内容。如果输出被截断，会在开头和结尾之间插入截断标记，说明丢弃了多少字节
+func (buffer *cappedBuffer) Bytes() []byte {
+
+	if buffer.tailLen == 0 {
+		return buffer.head
+	}
+
+	result := make([]byte, 0, len(buffer.head)+buffer.tailLen+64)
+	result = append(result, buffer.head...)
+
+	if dropped := buffer.total - int64(len(buffer.head)+buffer.tailLen); dropped > 0 {
+		result = append(result,
+			fmt.Sprintf("\n...[%d bytes truncated]...\n", dropped)...)
+	}
+
+	if buffer.tailLen < len(buffer.tail) {
+		result = append(result, buffer.tail[:buffer.tailLen]...)
+	} else {
+		result = append(result, buffer.tail[buffer.tailPos:]...)
+		result = append(result, buffer.tail[:buffer.tailPos]...)
+	}
+
+	return result
+}
+
+// 命令的输出管道，worker把管道中的内容复制到输出的Writer中
+// 命令的stdout和stderr不直接使用Writer，否则exec.Cmd.Wait会等到所有持有管道的进程都关闭它才返回，
+// 离开了进程组的子进程(例如调用了setsid的进程)没有被结束时，这次执行永远不会结束
+type outputPipes struct {
+	readers []*os.File
+	writers []*os.File
+	copied  sync.WaitGroup
+}
+
+// 为命令创建stdout和stderr的管道，并开始复制管道中的输出
+func openOutputPipes(cmd *exec.Cmd, stdout io.Writer, stderr io.Writer) (*outputPipes, error) {
+
+	pipes := &outputPipes{}
+	for _, writer := range []io.Writer{stdout, stderr} {
+		reader, pipeWriter, err := os.Pipe()
+		if err != nil {
+			pipes.closeWriters()
+			pipes.close(0)
+			return nil, err
+		}
+		pipes.readers = append(pipes.readers, reader)
+		pipes.writers = append(pipes.writers, pipeWriter)
+
+		pipes.copied.Add(1)
+		go func(writer io.Writer) {
+			defer pipes.copied.Done()
+			_, _ = io.Copy(writer, reader)
+		}(writer)
+	}
+
+	cmd.Stdout = pipes.writers[0]
+	cmd.Stderr = pipes.writers[1]
+	return pipes, nil
+}
+
+// 关闭worker持有的写入端，需要在命令启动之后调用，之后管道只由命令的进程持有
+func (pipes *outputPipes) closeWriters() {
+	for _, writer := range pipes.writers {
+		_ = writer.Close()
+	}
+}
+
+// 等待输出复制完成，即所有持有管道的进程都已经退出；超过timeout时关闭读取端，丢弃之后的输出
+// 返回之后不会再写入输出的Writer
+func (pipes *outputPipes) close(timeout time.Duration) {
+
+	copied := make(chan struct{})
+	go func() {
+		pipes.copied.Wait()
+		close(copied)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-copied:
+	case <-timer.C:
+	}
+
+	for _, reader := range pipes.readers {
+		_ = reader.Close()
+	}
+	<-copied
+}
@@ -0,0 +1,234 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/etcd"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+const (
+	// 输出流的刷新间隔
+	outputStreamFlushInterval = 500 * time.Millisecond
+	// 缓存的输出超过这个大小时立即刷新
+	outputStreamFlushSize = 16 * 1024
+	// 缓存的输出上限，推送不及时导致缓存超过这个大小时，新的输出不再推送
+	outputStreamMaxPending = 1024 * 1024
+	// 每次运行最多推送的输出字节数
+	outputStreamMaxBytes = 1024 * 1024
+	// 每秒最多推送的输出字节数和put次数，每一次put都会产生一个etcd revision
+	outputStreamMaxRate    = 64 * 1024
+	outputStreamMaxPutRate = 20
+	// 输出流key的租约时间，单位为秒。worker宕机后key会在租约到期后自动删除
+	outputStreamTTL = 10
+)
+
+// Job输出流，用于把运行中job的输出实时推送到etcd，master可以通过监听etcd来跟踪job的输出
+// 每次运行的输出都保存在JobOutputPrefix/jobName/runId这个key下，每一段输出都是对这个key的一次put，
+// 因此从key的创建revision开始监听就可以按顺序拿到这次运行的所有输出。
+// 运行结束时会写入一个Eof的输出段，随后释放租约，key被删除
+// 推送的输出超过单次运行的上限或者速率上限时，写入一个Stopped的输出段并停止推送，完整的输出以job log为准
+type OutputStream struct {
+	etcd.Connector
+
+	key        string
+	leaseId    clientv3.LeaseID
+	cancelFunc context.CancelFunc
+
+	lock    sync.Mutex
+	pending []*protocol.JobOutputChunk
+	size    int
+	stopped bool
+
+	// 推送的统计，只在flush中使用
+	sent        int
+	windowStart time.Time
+	windowBytes int
+	windowPuts  int
+
+	done chan struct{}
+	wait sync.WaitGroup
+}
+
+// 开始一个job运行的输出流，会创建带租约的输出key并启动后台刷新
+func BeginOutputStream(info *JobExecuteInfo, conn *etcd.Connector) (*OutputStream, error) {
+
+	stream := &OutputStream{
+		Connector: *conn,
+		key:       common.JobOutputPrefix + info.Job.Name + "/" + info.RunID,
+		done:      make(chan struct{}),
+	}
+
+	leaseResponse, err := stream.Lease.Grant(context.TODO(), outputStreamTTL)
+	if err != nil {
+		return nil, err
+	}
+	stream.leaseId = leaseResponse.ID
+
+	cancelCtx, cancelFunc := context.WithCancel(context.TODO())
+	stream.cancelFunc = cancelFunc
+
+	keepChan, err := stream.Lease.KeepAlive(cancelCtx, stream.leaseId)
+	if err != nil {
+		stream.release()
+		return nil, err
+	}
+	// 自动续租
+	go func() {
+		for range keepChan {
+		}
+	}()
+
+	// 写入一个空的输出段，表示运行开始
+	if err := stream.put(&protocol.JobOutputChunk{}); err != nil {
+		stream.release()
+		return nil, err
+	}
+
+	stream.wait.Add(1)
+	go stream.flushLoop()
+
+	return stream, nil
+}
+
+// 取得某个输出(stdout或stderr)的Writer，写入的内容会被推送到输出流中
+func (stream *OutputStream) Writer(name string) *OutputStreamWriter {
+	return &OutputStreamWriter{stream: stream, name: name}
+}
+
+// 结束输出流，推送剩余的输出和Eof标记，随后释放租约
+func (stream *OutputStream) End() {
+
+	close(stream.done)
+	stream.wait.Wait()
+
+	stream.flush()
+	_ = stream.put(&protocol.JobOutputChunk{Eof: true})
+	stream.release()
+}
+
+// 缓存一段输出，连续的同一个输出会被合并
+// 输出流只用于实时查看，缓存超过上限时丢弃新的输出，完整的输出以job log为准
+func (stream *OutputStream) append(name string, p []byte) {
+
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if stream.stopped || stream.size+len(p) > outputStreamMaxPending {
+		return
+	}
+
+	n := len(stream.pending)
+	if n > 0 && stream.pending[n-1].Stream == name {
+		stream.pending[n-1].Data += string(p)
+	} else {
+		stream.pending = append(stream.pending,
+			&protocol.JobOutputChunk{Stream: name, Data: string(p)})
+	}
+	stream.size += len(p)
+}
+
+// 定时把缓存的输出推送到etcd
+func (stream *OutputStream) flushLoop() {
+
+	defer stream.wait.Done()
+
+	ticker := time.NewTicker(outputStreamFlushInterval / 5)
+	defer ticker.Stop()
+
+	lastFlush := time.Now()
+	for {
+		select {
+		case <-stream.done:
+			return
+		case <-ticker.C:
+			stream.lock.Lock()
+			size := stream.size
+			stream.lock.Unlock()
+
+			if size >= outputStreamFlushSize ||
+				(size > 0 && time.Since(lastFlush) >= outputStreamFlushInterval) {
+				stream.flush()
+				lastFlush = time.Now()
+			}
+		}
+	}
+}
+
+// 把缓存的输出推送到etcd，推送失败的输出会被丢弃
+// 超过推送的上限时停止推送，见allow
+func (stream *OutputStream) flush() {
+
+	stream.lock.Lock()
+	pending := stream.pending
+	size := stream.size
+	stream.pending = nil
+	stream.size = 0
+	stream.lock.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	if !stream.allow(size, len(pending), time.Now()) {
+		stream.lock.Lock()
+		stream.stopped = true
+		stream.lock.Unlock()
+		_ = stream.put(&protocol.JobOutputChunk{Stopped: true})
+		return
+	}
+
+	for _, chunk := range pending {
+		_ = stream.put(chunk)
+	}
+}
+
+// 记录一次推送，推送之后超过单次运行的字节数上限，或者一秒内推送的字节数、put次数超过速率上限时返回false
+func (stream *OutputStream) allow(size int, puts int, now time.Time) bool {
+
+	if now.Sub(stream.windowStart) >= time.Second {
+		stream.windowStart = now
+		stream.windowBytes = 0
+		stream.windowPuts = 0
+	}
+	stream.sent += size
+	stream.windowBytes += size
+	stream.windowPuts += puts
+
+	return stream.sent <= outputStreamMaxBytes &&
+		stream.windowBytes <= outputStreamMaxRate && stream.windowPuts <= outputStreamMaxPutRate
+}
+
+func (stream *OutputStream) put(chunk *protocol.JobOutputChunk) error {
+
+	value, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+
+	_, err = stream.Kv.Put(context.TODO(), stream.key,
+		string(value), clientv3.WithLease(stream.leaseId))
+	return err
+}
+
+// 释放输出流的租约，key会被删除
+func (stream *OutputStream) release() {
+	stream.cancelFunc()
+	_, _ = stream.Lease.Revoke(context.TODO(), stream.leaseId)
+}
+
+// 输出流的Writer，实现了io.Writer接口
+type OutputStreamWriter struct {
+	stream *OutputStream
+	name   string
+}
+
+// 写入输出，永远不会返回错误
+func (writer *OutputStreamWriter) Write(p []byte) (int, error) {
+	writer.stream.append(writer.name, p)
+	return len(p), nil
+}
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCappedBuffer(t *testing.T) {
+
+	buffer := newCappedBuffer(10)
+	_, _ = buffer.Write([]byte("12345678"))
+	if string(buffer.Bytes()) != "12345678" || buffer.Truncated() {
+		t.Errorf("Error Bytes: %q", buffer.Bytes())
+	}
+
+	buffer = newCappedBuffer(10)
+	for i := 0; i < 7; i++ {
+		_, _ = buffer.Write([]byte("abc"))
+	}
+	if !buffer.Truncated() {
+		t.Errorf("Error Truncated: %q", buffer.Bytes())
+	}
+	if string(buffer.Bytes()) != "abcab\n...[11 bytes truncated]...\nbcabc" {
+		t.Errorf("Error Bytes: %q", buffer.Bytes())
+	}
+
+	buffer = newCappedBuffer(0)
+	_, _ = buffer.Write([]byte(strings.Repeat("x", 1000)))
+	if len(buffer.Bytes()) != 1000 || buffer.Truncated() {
+		t.Errorf("Error unlimited Bytes: %d", len(buffer.Bytes()))
+	}
+}
+
+func TestOutputStreamAllow(t *testing.T) {
+
+	now := time.Now()
+	stream := &OutputStream{}
+	if !stream.allow(outputStreamMaxRate, 1, now) {
+		t.Errorf("Error allow: rate limit exceeded too early")
+	}
+	if stream.allow(1, 1, now.Add(500*time.Millisecond)) {
+		t.Errorf("Error allow: byte rate not limited")
+	}
+
+	stream = &OutputStream{}
+	if stream.allow(1, outputStreamMaxPutRate+1, now) {
+		t.Errorf("Error allow: put rate not limited")
+	}
+
+	stream = &OutputStream{}
+	for i := 0; i < outputStreamMaxBytes/outputStreamMaxRate; i++ {
+		if !stream.allow(outputStreamMaxRate, 1, now.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("Error allow: second %d limited", i)
+		}
+	}
+	if stream.allow(1, 1, now.Add(time.Hour)) {
+		t.Errorf("Error allow: run limit not reached")
+	}
+}
@@ -0,0 +1,94 @@
+package worker
+
+import (
+	"container/heap"
+	"time"
+)
+
+// 调度计划的优先队列，是一个以NextTime为key的最小堆，堆顶为最早需要执行的计划
+// 计划在堆中的位置保存在计划的index字段中，不在堆中的计划index为-1
+// 这样调度器每次只需要查看堆顶的计划，更新计划的复杂度为O(log n)
+type planQueue []*JobSchedulePlan
+
+func (queue planQueue) Len() int {
+	return len(queue)
+}
+
+func (queue planQueue) Less(i, j int) bool {
+	return queue[i].NextTime.Before(queue[j].NextTime)
+}
+
+func (queue planQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].index = i
+	queue[j].index = j
+}
+
+func (queue *planQueue) Push(x interface{}) {
+	plan := x.(*JobSchedulePlan)
+	plan.index = len(*queue)
+	*queue = append(*queue, plan)
+}
+
+func (queue *planQueue) Pop() interface{} {
+	old := *queue
+	n := len(old)
+	plan := old[n-1]
+	old[n-1] = nil
+	plan.index = -1
+	*queue = old[:n-1]
+	return plan
+}
+
+// 取得最早需要执行的计划，队列为空时返回nil
+func (queue planQueue) peek() *JobSchedulePlan {
+	if len(queue) == 0 {
+		return nil
+	}
+	return queue[0]
+}
+
+// 把计划加到计划表和优先队列中，如果job已经有计划了，旧的计划会被替换
+// 没有下一次执行时间的计划只保存在计划表中，不会被调度
+func (scheduler *SchedulerBody) putPlan(plan *JobSchedulePlan) {
+
+	scheduler.removePlan(plan.Job.Name)
+
+	scheduler.planTable[plan.Job.Name] = plan
+	plan.index = -1
+	if !plan.NextTime.IsZero() {
+		heap.Push(&scheduler.planQueue, plan)
+	}
+}
+
+// 从计划表和优先队列中删除job的计划
+func (scheduler *SchedulerBody) removePlan(jobName string) {
+
+	plan, exists := scheduler.planTable[jobName]
+	if !exists {
+		return
+	}
+
+	delete(scheduler.planTable, jobName)
+	if plan.index >= 0 {
+		heap.Remove(&scheduler.planQueue, plan.index)
+	}
+}
+
+// 更新计划的下一次执行时间，并调整计划在优先队列中的位置
+// 下一次执行时间为零值时，说明计划不会再执行了，从优先队列中移除
+func (scheduler *SchedulerBody) reschedulePlan(plan *JobSchedulePlan, nextTime time.Time) {
+
+	plan.NextTime = nextTime
+
+	switch {
+	case plan.index < 0:
+		if !nextTime.IsZero() {
+			heap.Push(&scheduler.planQueue, plan)
+		}
+	case nextTime.IsZero():
+		heap.Remove(&scheduler.planQueue, plan.index)
+	default:
+		heap.Fix(&scheduler.planQueue, plan.index)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 进程组中是否还有没有退出的进程
+// 僵尸进程已经退出，只是还没有被父进程回收(孤儿进程需要由init回收)，因此不算在内
+// 无法读取/proc时退化为检查进程组是否存在
+func processGroupAlive(pgid int) bool {
+
+	proc, err := os.Open("/proc")
+	if err != nil {
+		return syscall.Kill(-pgid, 0) != syscall.ESRCH
+	}
+	defer proc.Close()
+
+	names, err := proc.Readdirnames(-1)
+	if err != nil {
+		return syscall.Kill(-pgid, 0) != syscall.ESRCH
+	}
+
+	for _, name := range names {
+		if _, err := strconv.Atoi(name); err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/" + name + "/stat")
+		if err != nil {
+			continue
+		}
+		// stat的格式为"pid (comm) state ppid pgrp ..."，comm中可能有空格，因此从最后一个')'之后开始解析
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if len(fields) > 2 && fields[2] == strconv.Itoa(pgid) && fields[0] != "Z" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import "syscall"
+
+// 进程组中是否还有进程，僵尸进程也算在内
+func processGroupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) != syscall.ESRCH
+}
@@ -71,6 +71,11 @@ func (register *RegisterBody) keepOnline() {
 
 }
 
+// 取得当前worker的ID，即注册到etcd中的标识(本机ip或者uuid)
+func (register *RegisterBody) WorkerID() string {
+	return register.localIp
+}
+
 var (
 	Register RegisterBody
 )
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"math"
+	"time"
+
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+// 判断一次job执行结果是否需要重试
+// 只有执行失败的job才会重试，抢锁失败、被kill或者已经达到最大尝试次数的job不会重试
+// 如果重试策略限制了退出码，只有退出码在列表中的失败才会重试
+func shouldRetry(result *JobExecuteResult) bool {
+
+	info := result.ExecuteInfo
+	policy := info.Job.Retry
+
+	if policy == nil || result.Err == nil ||
+		result.Err == LockOccupiedError || result.Err == FireClaimedError {
+		return false
+	}
+
+	// 被kill的job不再重试
+	if info.CancelCtx.Err() != nil {
+		return false
+	}
+
+	if info.Attempt >= policy.MaxAttempts {
+		return false
+	}
+
+	if len(policy.ExitCodes) == 0 {
+		return true
+	}
+
+	for _, retryCode := range policy.ExitCodes {
+		if result.ExitCode == retryCode {
+			return true
+		}
+	}
+	return false
+}
+
+// 重试等待时间的上限，指数退避的等待时间翻倍到这个值之后不再增加，防止溢出
+const maxRetryDelay = time.Duration(math.MaxInt64)
+
+// 计算第attempt次执行失败后，距离下一次重试需要等待的时间
+func retryDelay(policy *protocol.RetryPolicy, attempt int) time.Duration {
+
+	delay := common.IntSecond(policy.Interval)
+
+	if policy.Backoff == protocol.RetryBackoffExponential {
+		for i := 1; i < attempt; i++ {
+			if delay > maxRetryDelay/2 {
+				delay = maxRetryDelay
+				break
+			}
+			delay *= 2
+			if policy.MaxInterval > 0 && delay > common.IntSecond(policy.MaxInterval) {
+				break
+			}
+		}
+		if policy.MaxInterval > 0 && delay > common.IntSecond(policy.MaxInterval) {
+			return common.IntSecond(policy.MaxInterval)
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,27 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestRetryDelay(t *testing.T) {
+
+	policy := &protocol.RetryPolicy{Backoff: protocol.RetryBackoffExponential, Interval: 1}
+	if delay := retryDelay(policy, 4); delay != 8*time.Second {
+		t.Errorf("Error retryDelay: attempt 4 delay=%v", delay)
+	}
+	// 不限制最大间隔时，翻倍到上限之后不会溢出
+	for _, attempt := range []int{40, 64, 100} {
+		if delay := retryDelay(policy, attempt); delay != maxRetryDelay {
+			t.Errorf("Error retryDelay: attempt %d delay=%v", attempt, delay)
+		}
+	}
+
+	policy.MaxInterval = 60
+	if delay := retryDelay(policy, 100); delay != time.Minute {
+		t.Errorf("Error retryDelay: capped delay=%v", delay)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package worker
+
+import (
+	"syscall"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+const rlimitsSupported = true
+
+// syscall包中没有定义RLIMIT_NPROC
+const rlimitNproc = 6
+
+// 设置当前进程的资源限制，为0的限制不设置
+// 由启动器在exec任务命令之前调用，资源限制会被命令继承
+func setRlimits(limits *protocol.Rlimits) error {
+
+	resources := []struct {
+		resource int
+		value    int64
+	}{
+		{syscall.RLIMIT_CPU, limits.Cpu},
+		{syscall.RLIMIT_NOFILE, limits.Nofile},
+		{syscall.RLIMIT_AS, limits.As},
+		{rlimitNproc, limits.Nproc},
+	}
+
+	for _, r := range resources {
+		if r.value <= 0 {
+			continue
+		}
+		rlimit := syscall.Rlimit{Cur: uint64(r.value), Max: uint64(r.value)}
+		if err := syscall.Setrlimit(r.resource, &rlimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestRunWithRlimits(t *testing.T) {
+
+	job := &protocol.Job{Name: "limits", Rlimits: &protocol.Rlimits{Nofile: 64}}
+	info := createTestExecuteInfo(job)
+
+	// 资源限制在exec之前设置，命令读取到的就是自己的限制
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("cat", "/proc/self/limits")
+	if err := runCommand(cmd, info, nil, &stdout, &stderr, &JobExecuteResult{}); err != nil {
+		t.Fatalf("Error runCommand: %v, stderr=%q", err, stderr.String())
+	}
+	if !regexp.MustCompile(`Max open files\s+64\s+64`).Match(stdout.Bytes()) {
+		t.Errorf("Error runCommand: limits=%s", stdout.String())
+	}
+}
+
+func TestRunAsWithRlimits(t *testing.T) {
+
+	if os.Getuid() != 0 {
+		t.Skip("run_as requires root")
+	}
+	dir, err := ioutil.TempDir("", "lazycron-cgroup")
+	if err != nil {
+		t.Fatalf("Error TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 启动器由内核切换用户，之后仍然可以设置资源限制，cgroup由worker写入
+	Executor = &ExecutorBody{allowedUsers: []string{"nobody"}}
+	defer func() { Executor = &ExecutorBody{} }()
+	job := &protocol.Job{Name: "limits", RunAs: &protocol.RunAs{User: "nobody"},
+		Rlimits: &protocol.Rlimits{Nofile: 64}}
+	info := createTestExecuteInfo(job)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", "id -u; cat /proc/self/limits")
+	if err := runCommand(cmd, info, &jobCgroup{path: dir}, &stdout, &stderr, &JobExecuteResult{}); err != nil {
+		t.Fatalf("Error runCommand: %v, stderr=%q", err, stderr.String())
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Fatalf("Error Lookup: %v", err)
+	}
+	if !strings.HasPrefix(stdout.String(), nobody.Uid+"\n") ||
+		!regexp.MustCompile(`Max open files\s+64\s+64`).Match(stdout.Bytes()) {
+		t.Errorf("Error runCommand: stdout=%s", stdout.String())
+	}
+	if procs, err := ioutil.ReadFile(dir + "/cgroup.procs"); err != nil || len(procs) == 0 {
+		t.Errorf("Error runCommand: cgroup.procs=%q err=%v", procs, err)
+	}
+}
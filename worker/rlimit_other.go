@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import (
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+const rlimitsSupported = false
+
+// 只有linux支持设置资源限制
+func setRlimits(*protocol.Rlimits) error {
+	return RlimitsNotSupportedError
+}
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+var (
+	RunAsNotAllowedError     = errors.New("run_as user is not allowed")
+	RlimitsNotSupportedError = errors.New("rlimits are only supported on linux")
+)
+
+// 判断job是否可以以这个用户执行，allowedUsers为worker的allowed_users配置，"*"表示所有用户
+func allowRunAs(allowedUsers []string, name string) bool {
+	for _, allowed := range allowedUsers {
+		if allowed == "*" || allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 得到以run_as指定的用户运行进程的Credential
+// 用户不在allowedUsers中时返回RunAsNotAllowedError；指定了用户组时，用户组必须是用户的主组或者附加组
+func runAsCredential(runAs *protocol.RunAs, allowedUsers []string) (*syscall.Credential, error) {
+
+	if !allowRunAs(allowedUsers, runAs.User) {
+		return nil, fmt.Errorf("%w: '%s'", RunAsNotAllowedError, runAs.User)
+	}
+
+	runUser, err := user.Lookup(runAs.User)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(runUser.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// 读取附加组失败时只使用主组
+	groupIds, err := runUser.GroupIds()
+	if err != nil {
+		groupIds = []string{runUser.Gid}
+	}
+
+	gidString := runUser.Gid
+	if runAs.Group != "" {
+		group, err := user.LookupGroup(runAs.Group)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(append(groupIds, runUser.Gid), group.Gid) {
+			return nil, fmt.Errorf("user '%s' is not a member of group '%s'", runAs.User, runAs.Group)
+		}
+		gidString = group.Gid
+		groupIds = []string{group.Gid}
+	}
+
+	gid, err := strconv.ParseUint(gidString, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	for _, groupId := range groupIds {
+		if id, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
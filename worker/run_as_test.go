@@ -0,0 +1,31 @@
+package worker
+
+import (
+	"errors"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+func TestRunAsCredential(t *testing.T) {
+
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("current user unknown: %v", err)
+	}
+
+	runAs := &protocol.RunAs{User: current.Username}
+	if _, err := runAsCredential(runAs, []string{"nobody"}); !errors.Is(err, RunAsNotAllowedError) {
+		t.Errorf("Error runAsCredential: user not in allowed_users accepted, err=%v", err)
+	}
+
+	credential, err := runAsCredential(runAs, []string{"*"})
+	if err != nil {
+		t.Fatalf("Error runAsCredential: %v", err)
+	}
+	if strconv.Itoa(int(credential.Uid)) != current.Uid || strconv.Itoa(int(credential.Gid)) != current.Gid {
+		t.Errorf("Error runAsCredential: uid=%d gid=%d", credential.Uid, credential.Gid)
+	}
+}
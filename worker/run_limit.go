@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+var MaxRunsReachedError = errors.New("job reached max runs")
+
+// 判断job的调度执行次数是否已经达到MaxRuns
+func reachMaxRuns(job *protocol.Job, runCount int64) bool {
+	return job.MaxRuns > 0 && runCount >= int64(job.MaxRuns)
+}
+
+// 获取到锁之后，为设置了MaxRuns的job占用一次执行次数，执行次数已经用完时返回MaxRunsReachedError
+// 执行次数为etcd中计数key的Version，通过事务保证多个worker不会超出MaxRuns
+// 手动执行、重试和跳过的执行不计入执行次数
+func takeRunTicket(info *JobExecuteInfo) error {
+
+	job := info.Job
+	if job.MaxRuns <= 0 || info.Trigger != nil || info.Attempt != 1 || info.SkipReason != "" {
+		return nil
+	}
+
+	countKey := common.JobRunCountPrefix + job.Name
+	txnResponse, err := JobWorker.Kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.Version(countKey), "<", job.MaxRuns)).
+		Then(clientv3.OpPut(countKey, strconv.FormatInt(common.ToMilli(info.PlanTime), 10))).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	if !txnResponse.Succeeded {
+		return MaxRunsReachedError
+	}
+	return nil
+}
+
+// 停止调度job，计划仍然保留以便手动执行，排队等待的执行和补执行的计划都会被丢弃
+func (scheduler *SchedulerBody) stopPlan(jobName string) {
+
+	if plan, exists := scheduler.planTable[jobName]; exists {
+		plan.Pending = nil
+		scheduler.reschedulePlan(plan, time.Time{})
+	}
+	delete(scheduler.jobQueueTable, jobName)
+}
+
+// 获取job已经调度执行的次数，没有记录或者获取失败时返回0
+func (jobWorker *JobWorkerBody) GetRunCount(name string) int64 {
+
+	getResponse, err := jobWorker.Kv.Get(context.TODO(), common.JobRunCountPrefix+name)
+	if err != nil || len(getResponse.Kvs) == 0 {
+		return 0
+	}
+	return getResponse.Kvs[0].Version
+}
@@ -3,26 +3,35 @@ package worker
 import (
 	"context"
 	"os"
+	"runtime"
+	"syscall"
 	"time"
 
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/calendar"
 	"github.com/golazycat/lazycron/common/joblog"
-
-	"github.com/gorhill/cronexpr"
+	"github.com/google/uuid"
 
 	"github.com/golazycat/lazycron/common/logs"
 	"github.com/golazycat/lazycron/common/protocol"
+	"github.com/golazycat/lazycron/common/schedule"
 )
 
 const timeFormat = "2006-01-02 15:04:05"
 
 // Job调度计划。Job的调度执行是依据cron表达式控制的，cron表达式决定了job多久执行一次
-// 因此需要这个结构体储存解析好的cron表达式对象，并保存job下一次执行的时间
+// 因此需要这个结构体储存解析好的调度表达式对象，并保存job下一次执行的时间
 // 调度器依据这个计划来在规定得时间执行job，并更新下一次执行时间
 // 每个计划对象和job对象是一对一的关系
+// Pending保存了排队等待补执行的计划时间，见错过执行策略
+// index为计划在调度器优先队列中的位置，不在队列中时为-1
 type JobSchedulePlan struct {
 	Job      *protocol.Job
-	Expr     *cronexpr.Expression
+	Schedule *schedule.Schedule
 	NextTime time.Time
+	Pending  []time.Time
+
+	index int
 }
 
 // Job执行信息。Job在执行前，需要创建这个对象传给Executor，里面存了Job执行前的一些参数
@@ -32,50 +41,157 @@ type JobSchedulePlan struct {
 // 另外，一个执行中的job可能随时会被kill掉，这个操作需要用到context的cancelContext
 // Executor在执行的时候需要注册这个context，随后Scheduler就可以随时通过cancelFunc来中途
 // 中断允许中的job了
+// Attempt表示这是job在这个计划时间的第几次尝试执行，第一次执行为1，失败重试时递增
+// RunID是每一次执行的唯一标识；Trigger不为nil时表示这次执行是手动触发的
+// SkipReason不为空时表示这次执行因为日历的限制需要跳过，Executor只会记录跳过的日志
 type JobExecuteInfo struct {
+	RunID      string
 	Job        *protocol.Job
 	PlanTime   time.Time
 	RealTime   time.Time
 	CancelCtx  context.Context
 	CancelFunc context.CancelFunc
+	Attempt    int
+	Trigger    *protocol.JobTrigger
+	SkipReason string
 }
 
 // Job执行结果。Job在由Executor执行完成后，Executor会创建这个对象并返回给Scheduler(通过channel)
 // 这里面保存了job执行的各种信息，包括执行的输出，是否成功，执行时间
+// stdout和stderr分开保存，超过输出上限时只保留开头和结尾，XxxTruncated表示输出是否被截断
+// 另外还保存了进程的退出码、终止信号以及资源使用情况，Status是归一化后的执行状态，见JobStatusXxx枚举
+// http类型的job没有进程，HttpStatus为响应的状态码
 // Scheduler收到这个对象会把对应的任务从执行表中删除，从而可以等待下一次执行
 type JobExecuteResult struct {
-	ExecuteInfo *JobExecuteInfo
-	Output      []byte
-	Err         error
-	StartTime   time.Time
-	EndTime     time.Time
+	ExecuteInfo     *JobExecuteInfo
+	Stdout          []byte
+	Stderr          []byte
+	StdoutTruncated bool
+	StderrTruncated bool
+	Err             error
+	StartTime       time.Time
+	EndTime         time.Time
+	Status          string
+	ExitCode        int
+	HttpStatus      int
+	Signal          int
+	UserTime        time.Duration
+	SystemTime      time.Duration
+	MaxRss          int64
+	MemoryPeak      int64
+	CpuUsage        time.Duration
+	KillReport      *protocol.JobKillReport
+}
+
+// 从进程退出状态中取得退出码、终止信号和资源使用情况
+// 命令没有成功启动时state为nil，此时退出码为-1
+func (result *JobExecuteResult) fillProcessState(state *os.ProcessState) {
+
+	if state == nil {
+		result.ExitCode = -1
+		return
+	}
+
+	result.ExitCode = state.ExitCode()
+	result.UserTime = state.UserTime()
+	result.SystemTime = state.SystemTime()
+
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.Signal = int(status.Signal())
+	}
+
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// linux下Maxrss的单位为KB，mac下为Byte，这里统一为KB
+		result.MaxRss = usage.Maxrss
+		if runtime.GOOS == "darwin" {
+			result.MaxRss /= 1024
+		}
+	}
 }
 
 // 创建调度计划，这个过程会解析job对象中的cron表达式，如果解析失败，会返回错误
-func CreateJobSchedulerPlan(job *protocol.Job) (*JobSchedulePlan, error) {
+// lastFireTime为job上一次被执行的计划时间，如果job设置了需要补执行的错过执行策略，
+// 下一次执行时间会从lastFireTime开始计算，这样重启的worker也能发现停机期间错过的执行
+// runCount为job已经调度执行的次数，达到MaxRuns时计划不再调度；超过调度时间范围的计划也不再调度
+func CreateJobSchedulerPlan(job *protocol.Job, lastFireTime time.Time,
+	runCount int64) (*JobSchedulePlan, error) {
 
-	expr, err := cronexpr.Parse(job.CronExpr)
+	jobSchedule, err := schedule.Parse(job)
 	if err != nil {
 		return nil, err
 	}
+
+	from := time.Now()
+	if job.Misfire != nil && job.Misfire.Policy != protocol.MisfireSkip &&
+		job.Misfire.Policy != "" && !lastFireTime.IsZero() && lastFireTime.Before(from) {
+		from = lastFireTime
+	}
+
+	// 一次性job从上一次执行开始计算，这样即使执行时间已经过去，没有执行过的job也会执行一次
+	if isOnceJob(job) {
+		from = lastFireTime
+	}
+
+	nextTime := jobSchedule.Next(from)
+
+	// 已完成的一次性job和执行次数用完的job不再调度，只保留计划以便手动执行
+	if job.Completed || reachMaxRuns(job, runCount) {
+		nextTime = time.Time{}
+	}
+
 	plan := JobSchedulePlan{
 		Job:      job,
-		Expr:     expr,
-		NextTime: expr.Next(time.Now()),
+		Schedule: jobSchedule,
+		NextTime: nextTime,
+		index:    -1,
 	}
 	return &plan, nil
 }
 
-// 创建Job执行信息，执行信息中的PlanTime由计划plan的NextTime决定，而RealTime由当前时间决定
-func CreateJobExecuteInfo(plan *JobSchedulePlan) *JobExecuteInfo {
+// 创建Job执行信息，执行信息中的PlanTime为计划的执行时间，而RealTime由当前时间决定
+func CreateJobExecuteInfo(plan *JobSchedulePlan, planTime time.Time) *JobExecuteInfo {
 
 	cancelCtx, cancelFunc := context.WithCancel(context.TODO())
 	return &JobExecuteInfo{
+		RunID:      uuid.New().String(),
 		Job:        plan.Job,
-		PlanTime:   plan.NextTime,
+		PlanTime:   planTime,
 		RealTime:   time.Now(),
 		CancelCtx:  cancelCtx,
 		CancelFunc: cancelFunc,
+		Attempt:    1,
+	}
+}
+
+// 创建手动触发的Job执行信息，PlanTime为触发的时间(使用job的时区)
+func CreateJobTriggerInfo(plan *JobSchedulePlan, trigger *protocol.JobTrigger) *JobExecuteInfo {
+
+	cancelCtx, cancelFunc := context.WithCancel(context.TODO())
+	return &JobExecuteInfo{
+		RunID:      uuid.New().String(),
+		Job:        plan.Job,
+		PlanTime:   common.FromMilli(trigger.TriggerTime).In(plan.Schedule.Location()),
+		RealTime:   time.Now(),
+		CancelCtx:  cancelCtx,
+		CancelFunc: cancelFunc,
+		Attempt:    1,
+		Trigger:    trigger,
+	}
+}
+
+// 创建Job重试的执行信息，重试保持上一次执行的计划时间，尝试次数加1
+func CreateJobRetryInfo(info *JobExecuteInfo) *JobExecuteInfo {
+
+	cancelCtx, cancelFunc := context.WithCancel(context.TODO())
+	return &JobExecuteInfo{
+		RunID:      uuid.New().String(),
+		Job:        info.Job,
+		PlanTime:   info.PlanTime,
+		RealTime:   time.Now(),
+		CancelCtx:  cancelCtx,
+		CancelFunc: cancelFunc,
+		Attempt:    info.Attempt + 1,
+		Trigger:    info.Trigger,
 	}
 }
 
@@ -83,15 +199,26 @@ func CreateJobExecuteInfo(plan *JobSchedulePlan) *JobExecuteInfo {
 // jobEventChan: 用于从JobWorker那里获取job的变化事件从而进行处理
 // jobResultChan: 用于从Executor那里获取job的执行结果
 // planTable: 保存当前所有job的计划，里面有重要的下一次执行时间
-// jobExecuteTable: 保存当前正在执行的所有jobs，key是jobName，value是job plan
+// planQueue: 以下一次执行时间排序的计划优先队列，和planTable中需要调度的计划一一对应
+// jobExecuteTable: 保存当前正在执行的所有jobs，key是jobName，value是这个job正在执行的实例，key为RunID
+// jobQueueTable: queue策略下，保存本worker上排队等待执行的jobs，key是jobName
+// calendarTable: 保存当前所有的日历，key是日历名称
 // logJob: 在job调度执行的过程中是否输出日志，注意如果设为true，日志将会很长
+// logLockSkipped: 是否把因为抢锁失败而跳过的执行写入job log
+// execute: 代替Executor执行job，为空时交给Executor，测试中用来不依赖etcd驱动调度
 type SchedulerBody struct {
 	jobEventChan    chan *protocol.JobEvent
 	jobResultChan   chan *JobExecuteResult
 	planTable       map[string]*JobSchedulePlan
-	jobExecuteTable map[string]*JobExecuteInfo
+	planQueue       planQueue
+	jobExecuteTable map[string]map[string]*JobExecuteInfo
+	jobQueueTable   map[string][]*JobExecuteInfo
+	calendarTable   map[string]*calendar.Calendar
+
+	logJob         bool
+	logLockSkipped bool
 
-	logJob bool
+	execute func(info *JobExecuteInfo)
 }
 
 // 开始调度，调用这个函数，调度器开始工作
@@ -106,12 +233,17 @@ func (scheduler *SchedulerBody) BeginScheduling() {
 
 // 处理一个job事件。job事件由JobWorker负责监听并发给Scheduler
 // 如果事件是更新，则需要为这个job创建新的计划并加到计划表里；如果是删除，则需要从计划表里删除这个job
-// 如果事件是强杀，
+// 如果事件是强杀，需要中断这个job正在进行的执行(事件指定了RunID时只中断这一次执行)；如果事件是手动触发，则立即执行一次这个job
+// 日历的更新和删除事件会更新日历表
 func (scheduler *SchedulerBody) handleJobEvent(jobEvent *protocol.JobEvent) {
 
 	switch jobEvent.EventType {
 	case protocol.JobEventUpdate:
-		plan, err := CreateJobSchedulerPlan(jobEvent.Job)
+		var lastFireTime time.Time
+		if jobEvent.LastFireTime != 0 {
+			lastFireTime = common.FromMilli(jobEvent.LastFireTime)
+		}
+		plan, err := CreateJobSchedulerPlan(jobEvent.Job, lastFireTime, jobEvent.RunCount)
 		if err != nil {
 			if scheduler.logJob {
 				logs.Warn.Printf("invalid cron expr '%s', the job named %s"+
@@ -119,48 +251,105 @@ func (scheduler *SchedulerBody) handleJobEvent(jobEvent *protocol.JobEvent) {
 			}
 			return
 		}
-		scheduler.planTable[jobEvent.Job.Name] = plan
+		scheduler.putPlan(plan)
 
 	case protocol.JobEventDelete:
-		if _, exists := scheduler.planTable[jobEvent.Job.Name]; exists {
-			delete(scheduler.planTable, jobEvent.Job.Name)
-		}
+		scheduler.removePlan(jobEvent.Job.Name)
+		delete(scheduler.jobQueueTable, jobEvent.Job.Name)
 
 	case protocol.JobEventKill:
-		if jobExecuteInfo, exist :=
-			scheduler.jobExecuteTable[jobEvent.Job.Name]; exist {
+		scheduler.killJob(jobEvent.Job.Name, jobEvent.RunID)
 
-			jobExecuteInfo.CancelFunc()
+	case protocol.JobEventCalendarUpdate:
+		compiled, err := calendar.Compile(jobEvent.Calendar)
+		if err != nil {
+			logs.Warn.Printf("invalid calendar %s: %s", jobEvent.Calendar.Name, err)
+			delete(scheduler.calendarTable, jobEvent.Calendar.Name)
+			return
+		}
+		scheduler.calendarTable[jobEvent.Calendar.Name] = compiled
+
+	case protocol.JobEventCalendarDelete:
+		delete(scheduler.calendarTable, jobEvent.Calendar.Name)
 
+	case protocol.JobEventRun:
+		plan, exists := scheduler.planTable[jobEvent.Job.Name]
+		if !exists {
 			if scheduler.logJob {
-				logs.Info.Printf("killed job: %s", jobEvent.Job.Name)
+				logs.Warn.Printf("trigger job failed, no plan for job: %s",
+					jobEvent.Job.Name)
+			}
+			if jobEvent.Trigger.WorkflowRunID != "" {
+				rejectWorkflowRun(&JobExecuteInfo{
+					RunID:    uuid.New().String(),
+					Job:      jobEvent.Job,
+					PlanTime: common.FromMilli(jobEvent.Trigger.TriggerTime),
+					RealTime: time.Now(),
+					Attempt:  1,
+					Trigger:  jobEvent.Trigger,
+				}, NoJobPlanError)
 			}
+			return
 		}
+		scheduler.executeJob(CreateJobTriggerInfo(plan, jobEvent.Trigger))
 	}
 
 }
 
 // 处理一个job运行结果。运行结果是由Executor返回给Scheduler的
 // 当job执行完毕，需要及时从执行中任务列表中删除这个job
+// 如果job执行失败并且重试策略允许，会在退避时间后重新执行这个job；否则执行排队等待的执行和补执行的计划
+// 固定延迟的job在执行都结束后，从结束时间开始计算下一次执行时间
+// 执行次数用完的job会停止调度
 func (scheduler *SchedulerBody) handleJobResult(jobResult *JobExecuteResult) {
 
 	jobName := jobResult.ExecuteInfo.Job.Name
 
-	// 从执行任务中删除该job
-	delete(scheduler.jobExecuteTable, jobName)
+	// 从执行任务中删除这次执行
+	scheduler.removeExecuting(jobResult.ExecuteInfo)
+
+	// 执行次数已经用完，停止调度这个job，不记录日志
+	if jobResult.Err == MaxRunsReachedError {
+		scheduler.stopPlan(jobName)
+		return
+	}
 
 	// 生成job log，加到db
-	if jobResult.Err != LockOccupiedError {
+	lockSkipped := jobResult.Err == LockOccupiedError || jobResult.Err == FireClaimedError
+	if !lockSkipped || scheduler.logLockSkipped {
 
 		job := jobResult.ExecuteInfo.Job
 		jobLog := protocol.JobLog{
 			JobName:          job.Name,
-			Command:          job.Command,
-			Output:           string(jobResult.Output),
+			Command:          jobCommand(job),
+			Stdout:           string(jobResult.Stdout),
+			Stderr:           string(jobResult.Stderr),
+			StdoutTruncated:  jobResult.StdoutTruncated,
+			StderrTruncated:  jobResult.StderrTruncated,
 			PlanTime:         jobResult.ExecuteInfo.PlanTime.UnixNano() / 1000 / 1000,
+			Timezone:         jobResult.ExecuteInfo.PlanTime.Location().String(),
 			ScheduleTime:     jobResult.ExecuteInfo.RealTime.UnixNano() / 1000 / 1000,
 			ExecuteStartTime: jobResult.StartTime.UnixNano() / 1000 / 1000,
 			ExecuteEndTime:   jobResult.EndTime.UnixNano() / 1000 / 1000,
+			Attempt:          jobResult.ExecuteInfo.Attempt,
+			Status:           jobResult.Status,
+			ExitCode:         jobResult.ExitCode,
+			HttpStatus:       jobResult.HttpStatus,
+			Signal:           jobResult.Signal,
+			UserTime:         int64(jobResult.UserTime / time.Millisecond),
+			SystemTime:       int64(jobResult.SystemTime / time.Millisecond),
+			MaxRss:           jobResult.MaxRss,
+			MemoryPeak:       jobResult.MemoryPeak,
+			CpuUsage:         int64(jobResult.CpuUsage / time.Millisecond),
+			WorkerID:         Register.WorkerID(),
+			SkipReason:       jobResult.ExecuteInfo.SkipReason,
+		}
+
+		if trigger := jobResult.ExecuteInfo.Trigger; trigger != nil {
+			jobLog.Manual = true
+			jobLog.TriggeredBy = trigger.TriggeredBy
+			jobLog.Workflow = trigger.Workflow
+			jobLog.WorkflowRunID = trigger.WorkflowRunID
 		}
 
 		if jobResult.Err != nil {
@@ -168,33 +357,88 @@ func (scheduler *SchedulerBody) handleJobResult(jobResult *JobExecuteResult) {
 		} else {
 			jobLog.Err = ""
 		}
+		jobLog.TimedOut = jobResult.Err == JobTimeoutError
 
 		joblog.Logger.Insert(&jobLog)
 	}
+
+	if shouldRetry(jobResult) {
+		scheduler.retryJob(jobResult.ExecuteInfo)
+		return
+	}
+
+	// 一次性job执行成功，标记为已完成
+	if shouldComplete(jobResult) {
+		go JobWorker.CompleteOnceJob(jobResult.ExecuteInfo.Job)
+	}
+
+	// 工作流触发的执行，由认领了这次执行的worker上报最终的结果
+	if isWorkflowRun(jobResult.ExecuteInfo) && jobResult.Err != FireClaimedError {
+		go JobWorker.ReportWorkflowResult(jobResult)
+	}
+
+	// 执行排队等待的执行和补执行的计划
+	scheduler.dequeueJob(jobName)
+	if plan, exists := scheduler.planTable[jobName]; exists {
+		scheduler.executePending(plan)
+	}
+
+	scheduler.rescheduleFixedDelay(jobResult)
+}
+
+// 重新执行一个失败的job
+// 在等待重试期间，job会保留在执行表中，这样在重试结束前不会被再次调度，也可以被kill
+func (scheduler *SchedulerBody) retryJob(info *JobExecuteInfo) {
+
+	retryInfo := CreateJobRetryInfo(info)
+	scheduler.addExecuting(retryInfo)
+
+	delay := retryDelay(info.Job.Retry, info.Attempt)
+	if scheduler.logJob {
+		logs.Info.Printf("retry job: name=%s attempt=%d delay=%s",
+			info.Job.Name, retryInfo.Attempt, delay)
+	}
+
+	time.AfterFunc(delay, func() {
+		scheduler.submit(retryInfo)
+	})
 }
 
-// 浏览计划表中的所有job，执行其中需要执行的job，并更新下一次执行时间
+// 从计划优先队列中取出所有到期的job执行，并更新下一次执行时间
 // Scheduler需要不停地检查计划表，以确保job尽量在计划时间执行，因此这个函数会被反复调用
-// 为了节省CPU利用率，函数会返回计划表中从当前开始下一次job过期的最近时间(如果当前计划表为空，则返回1秒)
+// 计划按照下一次执行时间保存在最小堆中，因此只需要查看堆顶，每执行一个job的代价为O(log n)，和job的总数无关
+// 为了节省CPU利用率，函数会返回从当前开始下一次job过期的最近时间(如果当前没有需要调度的计划，则返回1秒)
 // 这样在调度时，可以随时修改该函数的调用时机为该值，以减少甚至杜绝空转(扫描了一次计划表，却没有任何job执行)的次数
 func (scheduler *SchedulerBody) scanPlanTable() time.Duration {
 
 	now := time.Now()
-	var near *time.Time = nil
 
-	for _, plan := range scheduler.planTable {
-		if plan.NextTime.Before(now) || plan.NextTime.Equal(now) {
-			scheduler.executeJob(plan)
-			plan.NextTime = plan.Expr.Next(now)
+	for {
+		plan := scheduler.planQueue.peek()
+		if plan == nil || plan.NextTime.After(now) {
+			break
 		}
 
-		if near == nil || plan.NextTime.Before(*near) {
-			near = &plan.NextTime
+		nextTime := plan.Schedule.Next(now)
+
+		// 暂停的job保留计划，只是不执行
+		if plan.Job.Paused {
+			if scheduler.logJob {
+				logs.Info.Printf("skip paused job: %s", plan.Job.Name)
+			}
+		} else {
+			scheduler.fireJob(plan, now)
+
+			// 固定延迟的job在执行结束后才计算下一次执行时间，见rescheduleFixedDelay
+			if isFixedDelay(plan.Job) {
+				nextTime = time.Time{}
+			}
 		}
+		scheduler.reschedulePlan(plan, nextTime)
 	}
 
-	if near != nil {
-		return (*near).Sub(now)
+	if near := scheduler.planQueue.peek(); near != nil {
+		return near.NextTime.Sub(now)
 	}
 
 	return time.Second
@@ -235,28 +479,108 @@ func (scheduler *SchedulerBody) scheduleLoop() {
 
 }
 
-// 执行job，这个函数会构造执行信息，并发送给Executor来实现对job的执行
-// 同时，会将job加到执行表中。
-// 如果job已经存在于执行表中了，说明该job的上一次执行还没有结束，将不会
-// 执行操作，以防止job的重复并发执行
-func (scheduler *SchedulerBody) executeJob(plan *JobSchedulePlan) {
+// 执行job，这个函数会把执行信息发送给Executor来实现对job的执行
+// 计划时间被job引用的日历排除时，不会执行job，只记录跳过的日志
+// job的上一次执行还没有结束时，依据job的并发执行策略处理：
+//     forbid/allow: 正在执行的实例达到上限时，不执行，以防止job的重复并发执行
+//     replace: 中断本worker上正在执行的实例，其它worker上的实例由Executor通过分布式锁中断
+//     queue: 正在执行的实例达到上限时，加到排队表中，等待前面的执行结束
+func (scheduler *SchedulerBody) executeJob(executeInfo *JobExecuteInfo) {
+
+	job := executeInfo.Job
+	if scheduler.skipByCalendar(executeInfo) {
+		return
+	}
 
-	if _, exists := scheduler.jobExecuteTable[plan.Job.Name]; !exists {
-		executeInfo := CreateJobExecuteInfo(plan)
-		scheduler.jobExecuteTable[plan.Job.Name] = executeInfo
-		Executor.Execute(executeInfo)
+	if !scheduler.reachConcurrencyLimit(job) {
+		scheduler.dispatchJob(executeInfo)
+		return
+	}
 
-		if scheduler.logJob {
-			logs.Info.Printf("execute job: plan=%s real=%s job=%s",
-				executeInfo.PlanTime.Format(timeFormat),
-				executeInfo.RealTime.Format(timeFormat), plan.Job)
+	switch concurrencyPolicy(job) {
+	case protocol.ConcurrencyReplace:
+		scheduler.killJob(job.Name, "")
+		scheduler.dispatchJob(executeInfo)
+
+	case protocol.ConcurrencyQueue:
+		queue := scheduler.jobQueueTable[job.Name]
+		if len(queue) >= maxQueuedRuns {
+			if scheduler.logJob {
+				logs.Warn.Printf("execute job failed, too many "+
+					"queued runs... name=%s", job.Name)
+			}
+			if isWorkflowRun(executeInfo) {
+				rejectWorkflowRun(executeInfo, TooManyQueuedRunsError)
+			}
+			return
 		}
-	} else {
+		scheduler.jobQueueTable[job.Name] = append(queue, executeInfo)
+
+	default:
 		if scheduler.logJob {
 			logs.Warn.Printf("execute job failed, job "+
-				"is still executing... name=%s", plan.Job.Name)
+				"is still executing... name=%s", job.Name)
 		}
+		// 工作流触发的执行仍然交给Executor，由它通过分布式锁得到跳过的结果并上报给工作流
+		if isWorkflowRun(executeInfo) {
+			scheduler.submit(executeInfo)
+		}
+	}
+}
+
+// 检查调度执行的计划时间是否被job引用的日历排除，被排除时交给Executor记录跳过的日志，返回true
+// 跳过的执行不会加到执行表中，也不受并发执行策略的限制；手动触发和重试不受日历的限制
+func (scheduler *SchedulerBody) skipByCalendar(executeInfo *JobExecuteInfo) bool {
+
+	if executeInfo.Trigger != nil || executeInfo.Attempt != 1 {
+		return false
+	}
+
+	reason := calendar.SkipReason(executeInfo.Job, scheduler.calendarTable, executeInfo.PlanTime)
+	if reason == "" {
+		return false
+	}
+
+	executeInfo.SkipReason = reason
+	scheduler.submit(executeInfo)
+
+	if scheduler.logJob {
+		logs.Info.Printf("skip job: name=%s plan=%s reason=%s", executeInfo.Job.Name,
+			executeInfo.PlanTime.Format(timeFormat), reason)
+	}
+	return true
+}
+
+// 把执行信息发送给Executor执行，同时将这次执行加到执行表中
+// 如果job设置了jitter，调度的执行会在延迟之后再交给Executor，延迟期间job已经在执行表中，可以被kill
+func (scheduler *SchedulerBody) dispatchJob(executeInfo *JobExecuteInfo) {
+
+	scheduler.addExecuting(executeInfo)
+
+	delay := jitterDelay(executeInfo)
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			scheduler.submit(executeInfo)
+		})
+	} else {
+		scheduler.submit(executeInfo)
+	}
+
+	if scheduler.logJob {
+		logs.Info.Printf("execute job: plan=%s real=%s delay=%s job=%+v",
+			executeInfo.PlanTime.Format(timeFormat),
+			executeInfo.RealTime.Format(timeFormat), delay, executeInfo.Job)
+	}
+}
+
+// 把执行信息交给Executor执行
+func (scheduler *SchedulerBody) submit(info *JobExecuteInfo) {
+
+	if scheduler.execute != nil {
+		scheduler.execute(info)
+		return
 	}
+	Executor.Execute(info)
 }
 
 // 提交一个job事件给Scheduler
@@ -291,7 +615,8 @@ var (
 
 // Scheduler初始化器
 type SchedulerInitializer struct {
-	LogJob bool
+	LogJob         bool
+	LogLockSkipped bool
 }
 
 // 初始化Scheduler
@@ -299,9 +624,12 @@ func (s SchedulerInitializer) Init() error {
 	Scheduler = SchedulerBody{
 		jobEventChan:    make(chan *protocol.JobEvent),
 		planTable:       make(map[string]*JobSchedulePlan),
-		jobExecuteTable: make(map[string]*JobExecuteInfo),
+		jobExecuteTable: make(map[string]map[string]*JobExecuteInfo),
+		jobQueueTable:   make(map[string][]*JobExecuteInfo),
+		calendarTable:   make(map[string]*calendar.Calendar),
 		jobResultChan:   make(chan *JobExecuteResult),
 		logJob:          s.LogJob,
+		logLockSkipped:  s.LogLockSkipped,
 	}
 	isSInit = true
 	return nil
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+// 创建有n个计划的调度器，到期的执行交给一个桩执行器，它只记录执行次数并立即结束执行，不依赖etcd
+func createBenchScheduler(b testing.TB, n int) (*SchedulerBody, *int) {
+
+	executed := 0
+	scheduler := &SchedulerBody{
+		planTable:       make(map[string]*JobSchedulePlan),
+		jobExecuteTable: make(map[string]map[string]*JobExecuteInfo),
+		jobQueueTable:   make(map[string][]*JobExecuteInfo),
+	}
+	scheduler.execute = func(info *JobExecuteInfo) {
+		executed++
+		scheduler.removeExecuting(info)
+	}
+
+	for i := 0; i < n; i++ {
+		job := &protocol.Job{
+			Name:     fmt.Sprintf("job-%d", i),
+			CronExpr: fmt.Sprintf("%d %d * * * * *", i%60, (i/60)%60),
+		}
+		plan, err := CreateJobSchedulerPlan(job, time.Time{}, 0)
+		if err != nil {
+			b.Fatalf("Error CreateJobSchedulerPlan: %v", err)
+		}
+		scheduler.putPlan(plan)
+	}
+
+	return scheduler, &executed
+}
+
+func TestPlanQueue(t *testing.T) {
+
+	scheduler, _ := createBenchScheduler(t, 1000)
+	dispatched := make(map[string]bool)
+	scheduler.execute = func(info *JobExecuteInfo) {
+		dispatched[info.Job.Name] = true
+		scheduler.removeExecuting(info)
+	}
+
+	due := scheduler.planTable["job-42"]
+	scheduler.reschedulePlan(due, time.Now().Add(-time.Second))
+	if scheduler.planQueue.peek() != due {
+		t.Fatalf("Error peek: expect due plan on top")
+	}
+
+	scheduler.scanPlanTable()
+	if !dispatched["job-42"] {
+		t.Errorf("Error scanPlanTable: due plan not dispatched")
+	}
+	if !due.NextTime.After(time.Now()) {
+		t.Errorf("Error scanPlanTable: due plan not rescheduled")
+	}
+
+	scheduler.removePlan("job-42")
+	if due.index != -1 || len(scheduler.planQueue) != 999 {
+		t.Errorf("Error removePlan: index=%d len=%d", due.index, len(scheduler.planQueue))
+	}
+
+	for i, plan := range scheduler.planQueue {
+		if plan.index != i {
+			t.Fatalf("Error index: plan %s at %d has index %d", plan.Job.Name, i, plan.index)
+		}
+		if i > 0 && plan.NextTime.Before(scheduler.planQueue[(i-1)/2].NextTime) {
+			t.Fatalf("Error heap: plan %s is earlier than its parent", plan.Job.Name)
+		}
+	}
+}
+
+// 每次让一个计划到期，测量调度器从发现到期、交给执行器到更新计划的时间
+func benchmarkDispatch(b *testing.B, n int) {
+
+	scheduler, executed := createBenchScheduler(b, n)
+	past := time.Now().Add(-time.Second)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plan := scheduler.planTable[fmt.Sprintf("job-%d", i%n)]
+		scheduler.reschedulePlan(plan, past)
+		scheduler.scanPlanTable()
+	}
+	b.StopTimer()
+
+	// 运行期间自然到期的计划也会执行，因此执行次数可能多于b.N
+	if *executed < b.N {
+		b.Fatalf("Error dispatch: expect at least %d executions, got %d", b.N, *executed)
+	}
+}
+
+func BenchmarkDispatch10k(b *testing.B) {
+	benchmarkDispatch(b, 10000)
+}
+
+func BenchmarkDispatch100k(b *testing.B) {
+	benchmarkDispatch(b, 100000)
+}
@@ -31,10 +31,15 @@ func Start(simple bool) {
 	baseinit.Init(JobWorkerInitializer{
 		Conf: workerConf}, "job worker")
 
-	baseinit.Init(ExecutorInitializer{}, "executor")
+	baseinit.Init(ExecutorInitializer{
+		OutputLimit:  workerConf.OutputLimit,
+		StreamOutput: workerConf.StreamOutput,
+		AllowedUsers: workerConf.AllowedUsers,
+		CgroupRoot:   workerConf.CgroupRoot}, "executor")
 
 	baseinit.Init(SchedulerInitializer{
-		LogJob: workerConf.LogJob}, "scheduler")
+		LogJob:         workerConf.LogJob,
+		LogLockSkipped: workerConf.LogLockSkipped}, "scheduler")
 
 	logs.Info.Printf("use conf: %+v", workerConf)
 
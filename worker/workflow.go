@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/golazycat/lazycron/common"
+	"github.com/golazycat/lazycron/common/logs"
+	"github.com/golazycat/lazycron/common/protocol"
+)
+
+var (
+	NoJobPlanError         = errors.New("job has no schedule plan")
+	TooManyQueuedRunsError = errors.New("too many queued runs")
+)
+
+// 判断一次执行是否是由工作流触发的
+func isWorkflowRun(info *JobExecuteInfo) bool {
+	return info.Trigger != nil && info.Trigger.WorkflowRunID != ""
+}
+
+// 工作流触发的执行无法在本worker上执行时(例如job没有调度计划、排队的执行已满)，上报失败的结果，
+// 否则工作流运行要等到master的期限才能结束
+// 和正常的执行一样需要先认领这一次执行，保证只有一个worker上报结果，已经被其它worker认领时什么都不做
+func rejectWorkflowRun(info *JobExecuteInfo, reason error) {
+
+	go func() {
+		jobLock := CreateJobLock(info, &JobWorker.Connector)
+		if err := jobLock.claim(); err != nil {
+			return
+		}
+
+		now := time.Now()
+		JobWorker.ReportWorkflowResult(&JobExecuteResult{
+			ExecuteInfo: info,
+			Err:         reason,
+			StartTime:   now,
+			EndTime:     now,
+			Status:      protocol.JobStatusFailed,
+			ExitCode:    -1,
+		})
+	}()
+}
+
+// 把工作流触发的执行结果上报到etcd，由master的工作流协调器处理并触发下游的job
+// 结果的key为工作流运行ID加job名称，协调器处理完成后会删除它
+func (jobWorker *JobWorkerBody) ReportWorkflowResult(result *JobExecuteResult) {
+
+	info := result.ExecuteInfo
+	state := protocol.WorkflowNodeState{
+		Status:    protocol.WorkflowStatusFailed,
+		JobStatus: result.Status,
+		ExitCode:  result.ExitCode,
+		WorkerID:  Register.WorkerID(),
+		StartTime: common.ToMilli(result.StartTime),
+		EndTime:   common.ToMilli(result.EndTime),
+	}
+	if result.Status == protocol.JobStatusSuccess {
+		state.Status = protocol.WorkflowStatusSuccess
+	}
+	if result.Err != nil {
+		state.Err = result.Err.Error()
+	}
+
+	stateValue, err := json.Marshal(&state)
+	if err != nil {
+		return
+	}
+
+	resultKey := common.WorkflowResultPrefix + info.Trigger.WorkflowRunID + "/" + info.Job.Name
+	if _, err := jobWorker.Kv.Put(context.TODO(), resultKey, string(stateValue)); err != nil {
+		logs.Warn.Printf("report workflow result of job %s error: %s", info.Job.Name, err)
+	}
+}